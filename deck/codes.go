@@ -0,0 +1,68 @@
+package deck
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownCode   = errors.New("unknown card code")
+	ErrNotInDeckType = errors.New("card is not part of the deck type")
+)
+
+// every code known to the service, that is the French deck and the jokers
+var knownCards = func() map[string]Card {
+	known := make(map[string]Card)
+	for _, card := range append(generateFullDeck(frenchDeckType), jokers...) {
+		known[card.Code] = card
+	}
+	return known
+}()
+
+// ParseCode returns the card for a code like "KD" or "10C", or an error
+// wrapping ErrUnknownCode
+func ParseCode(code string) (Card, error) {
+	card, found := knownCards[code]
+	if !found {
+		return Card{}, fmt.Errorf("%w: %q", ErrUnknownCode, code)
+	}
+	return card, nil
+}
+
+// CodeError is a card code rejected by ValidateCodes along with its position
+// in the list of codes
+type CodeError struct {
+	Position int
+	Code     string
+	Err      error
+}
+
+func (e *CodeError) Error() string {
+	return fmt.Sprintf("card code %q at position %d: %s", e.Code, e.Position, e.Err)
+}
+
+func (e *CodeError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateCodes checks every code against the deck type and returns all of
+// the rejected ones, so the caller can report them in one go
+func ValidateCodes(t DeckType, codes []string) []*CodeError {
+	allowed := make(map[string]bool)
+	for _, card := range append(generateFullDeck(t), jokers...) {
+		allowed[card.Code] = true
+	}
+
+	var rejected []*CodeError
+	for i, code := range codes {
+		if allowed[code] {
+			continue
+		}
+		err := ErrNotInDeckType
+		if _, parseErr := ParseCode(code); parseErr != nil {
+			err = ErrUnknownCode
+		}
+		rejected = append(rejected, &CodeError{Position: i, Code: code, Err: err})
+	}
+	return rejected
+}
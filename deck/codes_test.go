@@ -0,0 +1,65 @@
+package deck
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseCode(t *testing.T) {
+	tests := []struct {
+		code  string
+		value string
+		suit  string
+	}{
+		{"AS", "ACE", "SPADES"},
+		{"10C", "10", "CLUBS"},
+		{"QH", "QUEEN", "HEARTS"},
+		{"2D", "2", "DIAMONDS"},
+		{"X1", "JOKER", "BLACK"},
+		{"X2", "JOKER", "RED"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.code, func(t *testing.T) {
+			card, err := ParseCode(tc.code)
+			if err != nil {
+				t.Fatalf("ParseCode(%q) failed: %s", tc.code, err)
+			}
+			if card.Value != tc.value || card.Suit != tc.suit || card.Code != tc.code {
+				t.Errorf("ParseCode(%q) = %+v", tc.code, card)
+			}
+		})
+	}
+}
+
+func TestParseCodeUnknown(t *testing.T) {
+	for _, code := range []string{"", "GG", "IDDQD", "1S", "as", "X3"} {
+		if _, err := ParseCode(code); !errors.Is(err, ErrUnknownCode) {
+			t.Errorf("ParseCode(%q) expected ErrUnknownCode, got %v", code, err)
+		}
+	}
+}
+
+func TestValidateCodes(t *testing.T) {
+	dt, _ := LookupDeckType("euchre")
+	rejected := ValidateCodes(dt, []string{"AS", "GG", "9H", "2C", "X1", "IDDQD"})
+
+	want := []struct {
+		position int
+		code     string
+		err      error
+	}{
+		{1, "GG", ErrUnknownCode},
+		{3, "2C", ErrNotInDeckType},
+		{5, "IDDQD", ErrUnknownCode},
+	}
+	if len(rejected) != len(want) {
+		t.Fatalf("Expected %d rejected codes, got %v", len(want), rejected)
+	}
+	for i, w := range want {
+		r := rejected[i]
+		if r.Position != w.position || r.Code != w.code || !errors.Is(r, w.err) {
+			t.Errorf("At index %d expected %+v, got %+v", i, w, r)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package deck
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Commitment binds the service to the order of a deck before any card is
+// dealt. Only Hash is published on creation, Salt and Order are revealed once
+// the deck is exhausted or closed, so players can check the hash against them
+type Commitment struct {
+	Hash  string   `json:"hash"`
+	Salt  string   `json:"salt"`
+	Order []string `json:"order"`
+}
+
+// CommitmentHash is the hex encoded SHA-256 of the salt and the card codes
+// in deck order, formatted as "salt:AS,KD,10C"
+func CommitmentHash(salt string, order []string) string {
+	sum := sha256.Sum256([]byte(salt + ":" + strings.Join(order, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyCommitment checks that the revealed salt and order match the hash
+// published when the deck was created
+func VerifyCommitment(hash, salt string, order []string) bool {
+	return hmac.Equal([]byte(hash), []byte(CommitmentHash(salt, order)))
+}
+
+// Commit records a commitment to the current order of the cards with a fresh
+// random salt, the salt keeps the order from being guessed from the hash.
+// An earlier commitment is kept in PreviousCommitments, so the cards dealt
+// before the order changed can still be verified
+func (d *Deck) Commit() error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("generating commitment salt: %w", err)
+	}
+
+	order := make([]string, len(d.Cards))
+	for i, card := range d.Cards {
+		order[i] = card.Code
+	}
+	c := &Commitment{Salt: hex.EncodeToString(salt), Order: order}
+	c.Hash = CommitmentHash(c.Salt, c.Order)
+	if d.Commitment != nil {
+		d.PreviousCommitments = append(d.PreviousCommitments, *d.Commitment)
+	}
+	d.Commitment = c
+	return nil
+}
@@ -0,0 +1,68 @@
+package deck
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCommitAndVerify(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil)
+	if err := deck.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	c := deck.Commitment
+	if c == nil || len(c.Hash) != 64 || len(c.Salt) != 64 {
+		t.Fatalf("Unexpected commitment: %+v", c)
+	}
+	for i, card := range deck.Cards {
+		if c.Order[i] != card.Code {
+			t.Fatalf("Committed order differs from the deck at position %d", i)
+		}
+	}
+
+	if !VerifyCommitment(c.Hash, c.Salt, c.Order) {
+		t.Error("Commitment does not verify against its own salt and order")
+	}
+
+	swapped := append([]string(nil), c.Order...)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	if VerifyCommitment(c.Hash, c.Salt, swapped) {
+		t.Error("Commitment verified against a manipulated order")
+	}
+	if VerifyCommitment(c.Hash, c.Salt+"00", c.Order) {
+		t.Error("Commitment verified against a different salt")
+	}
+}
+
+func TestCommitmentHashIsStable(t *testing.T) {
+	// sha256 of "salt:AS,KD,10C", clients implementing the verification on
+	// their side should get the very same value
+	want := "a909575a717a25575ef62d0076607c7cbb4180108ddf9c9e04d0c5ea058138c3"
+	if got := CommitmentHash("salt", []string{"AS", "KD", "10C"}); got != want {
+		t.Errorf("CommitmentHash = %s, want %s", got, want)
+	}
+}
+
+func TestCommitKeepsPreviousCommitments(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil)
+	if err := deck.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	first := *deck.Commitment
+
+	deck.Draw(2)
+	deck.Shuffle()
+	if err := deck.Commit(); err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+	if len(deck.PreviousCommitments) != 1 || deck.PreviousCommitments[0].Hash != first.Hash {
+		t.Fatalf("Expected the first commitment to be kept, got %+v", deck.PreviousCommitments)
+	}
+	if deck.Commitment.Hash == first.Hash || len(deck.Commitment.Order) != 50 {
+		t.Errorf("Expected a new commitment to the 50 cards left, got %+v", deck.Commitment)
+	}
+	if !VerifyCommitment(first.Hash, first.Salt, first.Order) {
+		t.Error("Previous commitment does not verify")
+	}
+}
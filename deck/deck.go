@@ -2,6 +2,8 @@ package deck
 
 import (
 	"math/rand"
+	"slices"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -17,6 +19,84 @@ type Deck struct {
 	ID       uuid.UUID `json:"deck_id"`
 	Shuffled bool      `json:"shuffled"`
 	Cards    []Card    `json:"cards"`
+	// Type is the name of the DeckType the deck was built from
+	Type string `json:"type"`
+	// Decks is the number of base decks the deck (shoe) was built from
+	Decks int `json:"decks"`
+	// Algorithm is the shuffle algorithm chosen on creation
+	Algorithm string `json:"algorithm,omitempty"`
+	// Seed of the shuffle on creation, replaying it with the same algorithm
+	// on the unshuffled deck reproduces the deal
+	Seed *int64 `json:"seed,omitempty"`
+	// Drawn are the cards dealt from the deck and its piles, in the order they
+	// were dealt, which are the only cards that can be returned to the deck
+	Drawn []Card `json:"drawn,omitempty"`
+	// Piles are named sub-collections of cards moved out of the deck, like
+	// discard piles or player hands. The last card of a pile is its top
+	Piles map[string][]Card `json:"piles,omitempty"`
+	// Commitment to the order of the cards on creation, or on the last
+	// return or shuffle, see Commit
+	Commitment *Commitment `json:"commitment,omitempty"`
+	// PreviousCommitments are the commitments replaced by Commit, oldest
+	// first, they are revealed along with Commitment
+	PreviousCommitments []Commitment `json:"previous_commitments,omitempty"`
+	// Closed decks don't deal cards anymore and reveal their commitment
+	Closed    bool      `json:"closed"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastAccessedAt is updated by storage whenever the deck is used
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+	// TTL overrides the storage-wide time to live of unused decks
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Version is bumped by storage on every write and is used for
+	// optimistic concurrency control and ETags
+	Version int64 `json:"version"`
+	// Events are everything that happened to the deck, oldest first. Storage
+	// keeps them apart from the deck and only hands them out by DeckHistory,
+	// decks read otherwise carry just the events recorded on them since
+	Events []Event `json:"events,omitempty"`
+	// RecordedEvents is the number of events before Events which storage
+	// holds for the deck, see TakeEvents
+	RecordedEvents int `json:"recorded_events,omitempty"`
+}
+
+// Clone returns a deep copy of the deck, which shares no cards, piles or
+// events with it, so changing one never shows up in the other
+func (d Deck) Clone() Deck {
+	c := d
+	c.Cards = slices.Clone(d.Cards)
+	c.Drawn = slices.Clone(d.Drawn)
+	if d.Seed != nil {
+		seed := *d.Seed
+		c.Seed = &seed
+	}
+	if d.Piles != nil {
+		c.Piles = make(map[string][]Card, len(d.Piles))
+		for name, pile := range d.Piles {
+			c.Piles[name] = slices.Clone(pile)
+		}
+	}
+	if d.Commitment != nil {
+		commitment := *d.Commitment
+		commitment.Order = slices.Clone(d.Commitment.Order)
+		c.Commitment = &commitment
+	}
+	if d.PreviousCommitments != nil {
+		c.PreviousCommitments = make([]Commitment, len(d.PreviousCommitments))
+		for i, commitment := range d.PreviousCommitments {
+			commitment.Order = slices.Clone(commitment.Order)
+			c.PreviousCommitments[i] = commitment
+		}
+	}
+	if d.Events != nil {
+		c.Events = make([]Event, len(d.Events))
+		for i, e := range d.Events {
+			e.Cards = slices.Clone(e.Cards)
+			e.Positions = slices.Clone(e.Positions)
+			e.Order = slices.Clone(e.Order)
+			c.Events[i] = e
+		}
+	}
+	return c
 }
 
 func (d *Deck) Shuffle() {
@@ -24,6 +104,28 @@ func (d *Deck) Shuffle() {
 		d.Cards[i], d.Cards[j] = d.Cards[j], d.Cards[i]
 	})
 	d.Shuffled = true
+	d.record(Event{Type: EventShuffled, Order: codesOf(d.Cards)})
+}
+
+// ShuffleWithSource shuffles the deck using random numbers from src, so the
+// same source state always yields the same order
+func (d *Deck) ShuffleWithSource(src rand.Source) {
+	d.ShuffleWith(rand.New(src))
+}
+
+func (d *Deck) ShuffleWith(s Shuffler) {
+	s.Shuffle(len(d.Cards), func(i, j int) {
+		d.Cards[i], d.Cards[j] = d.Cards[j], d.Cards[i]
+	})
+	d.Shuffled = true
+	d.record(Event{Type: EventShuffled, Order: codesOf(d.Cards)})
+}
+
+// recordDraw records cards drawn from the deck along with their positions
+func (d *Deck) recordDraw(drawn []Card, positions []int) {
+	if len(drawn) > 0 {
+		d.record(Event{Type: EventDrawn, Cards: codesOf(drawn), Positions: positions})
+	}
 }
 
 // the case when more cards were requested is handled in http handler
@@ -33,34 +135,213 @@ func (d *Deck) Draw(numCards int) []Card {
 	}
 	drawn := d.Cards[:numCards]
 	d.Cards = d.Cards[numCards:]
+	d.Drawn = append(d.Drawn, drawn...)
+	d.recordDraw(drawn, make([]int, numCards))
 	return drawn
 }
 
-func NewDeck(id uuid.UUID, shuffle bool, cardCodes []string) *Deck {
+// DrawBottom draws up to numCards cards from the bottom of the deck, the
+// bottom card comes first
+func (d *Deck) DrawBottom(numCards int) []Card {
+	numCards = min(numCards, len(d.Cards))
+	drawn := make([]Card, 0, numCards)
+	positions := make([]int, 0, numCards)
+	for i := len(d.Cards) - 1; i >= len(d.Cards)-numCards; i-- {
+		drawn = append(drawn, d.Cards[i])
+		positions = append(positions, i)
+	}
+	d.Cards = d.Cards[: len(d.Cards)-numCards : len(d.Cards)-numCards]
+	d.Drawn = append(d.Drawn, drawn...)
+	d.recordDraw(drawn, positions)
+	return drawn
+}
+
+// DrawRandom draws up to numCards cards from random positions in the deck,
+// picked with the shuffle algorithm of the deck
+func (d *Deck) DrawRandom(numCards int) []Card {
+	numCards = min(numCards, len(d.Cards))
+	pick := pickerFor(d.Algorithm)
+	remaining := append([]Card(nil), d.Cards...)
+	drawn := make([]Card, 0, numCards)
+	positions := make([]int, 0, numCards)
+	for i := 0; i < numCards; i++ {
+		j := pick(len(remaining))
+		drawn = append(drawn, remaining[j])
+		positions = append(positions, j)
+		remaining = append(remaining[:j], remaining[j+1:]...)
+	}
+	d.Cards = remaining
+	d.Drawn = append(d.Drawn, drawn...)
+	d.recordDraw(drawn, positions)
+	return drawn
+}
+
+// DrawCodes pulls the cards with the given codes out of the deck, wherever
+// they are. Either all of the cards are drawn or, if any of them is not in
+// the deck, none of them
+func (d *Deck) DrawCodes(codes []string) ([]Card, error) {
+	remaining, drawn, positions, err := takeCodes(d.Cards, codes, ErrCardNotInDeck)
+	if err != nil {
+		return nil, err
+	}
+	d.Cards = remaining
+	d.Drawn = append(d.Drawn, drawn...)
+	d.recordDraw(drawn, positions)
+	return drawn, nil
+}
+
+// Return puts the drawn cards with the given codes back to the bottom of the
+// deck. Either all of the cards are returned or, if any of them was not
+// drawn from this deck, none of them
+func (d *Deck) Return(codes []string) error {
+	drawn, returned, _, err := takeCodes(d.Drawn, codes, ErrCardNotDrawn)
+	if err != nil {
+		return err
+	}
+	d.Drawn = drawn
+	// capping the capacity makes append copy the cards instead of writing
+	// past the end of a slice that may share its array with another deck
+	d.Cards = append(d.Cards[:len(d.Cards):len(d.Cards)], returned...)
+	if len(returned) > 0 {
+		d.record(Event{Type: EventReturned, Cards: codesOf(returned)})
+	}
+	return nil
+}
+
+// ReturnAll puts every drawn card back to the bottom of the deck and returns them
+func (d *Deck) ReturnAll() []Card {
+	returned := d.Drawn
+	d.Cards = append(d.Cards[:len(d.Cards):len(d.Cards)], returned...)
+	d.Drawn = nil
+	if len(returned) > 0 {
+		d.record(Event{Type: EventReturned, Cards: codesOf(returned)})
+	}
+	return returned
+}
+
+// Option tweaks the way NewDeck builds the deck
+type Option func(*options)
+
+type options struct {
+	deckType  DeckType
+	jokers    int
+	decks     int
+	algorithm string
+	seed      *int64
+	ttl       time.Duration
+}
+
+// WithType builds the deck from the given deck type instead of the default
+// French 52-card deck
+func WithType(t DeckType) Option {
+	return func(o *options) {
+		o.deckType = t
+	}
+}
+
+// WithJokers adds n jokers to the deck, alternating black and red ones
+func WithJokers(n int) Option {
+	return func(o *options) {
+		o.jokers = n
+	}
+}
+
+// WithDecks builds a shoe of n copies of the deck, like the 6- or 8-deck
+// shoes used for blackjack. The copies are combined before shuffling
+func WithDecks(n int) Option {
+	return func(o *options) {
+		o.decks = n
+	}
+}
+
+// WithAlgorithm picks the shuffle algorithm, see Algorithms for the names.
+// Unknown names fall back to DefaultAlgorithm
+func WithAlgorithm(name string) Option {
+	return func(o *options) {
+		o.algorithm = name
+	}
+}
+
+// WithSeed makes the shuffle on creation reproducible. Without it decks
+// shuffled with a seeded algorithm get a random seed, which is stored on the
+// deck either way
+func WithSeed(seed int64) Option {
+	return func(o *options) {
+		o.seed = &seed
+	}
+}
+
+// WithTTL makes storage evict the deck once it is not used for ttl
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+func NewDeck(id uuid.UUID, shuffle bool, cardCodes []string, opts ...Option) *Deck {
+	o := options{deckType: defaultDeckType(), decks: 1, algorithm: DefaultAlgorithm}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	var cards []Card
 	if len(cardCodes) > 0 {
-		cards = generateDeckFromCodes(cardCodes)
+		cards = generateDeckFromCodes(o.deckType, cardCodes)
 	} else {
-		cards = generateFullDeck()
+		cards = generateFullDeck(o.deckType)
 	}
+	for i := 0; i < o.jokers; i++ {
+		cards = append(cards, jokers[i%len(jokers)])
+	}
+	shoe := make([]Card, 0, len(cards)*o.decks)
+	for i := 0; i < o.decks; i++ {
+		shoe = append(shoe, cards...)
+	}
+	// monotonic clock readings don't survive serialization, so they are
+	// dropped to keep decks comparable after a round trip through storage
+	now := time.Now().UTC().Round(0)
 	deck := &Deck{
-		ID:       id,
-		Cards:    cards,
-		Shuffled: shuffle,
+		ID:             id,
+		Cards:          shoe,
+		Type:           o.deckType.Name,
+		Decks:          o.decks,
+		Shuffled:       shuffle,
+		CreatedAt:      now,
+		LastAccessedAt: now,
+		TTL:            o.ttl,
+		Version:        1,
 	}
+	if _, found := shuffleAlgorithms[o.algorithm]; !found {
+		o.algorithm = DefaultAlgorithm
+	}
+	deck.Algorithm = o.algorithm
+	deck.record(Event{Type: EventCreated, Order: codesOf(deck.Cards)})
 	if shuffle {
-		deck.Shuffle()
+		seed := rand.Int63()
+		if o.seed != nil {
+			seed = *o.seed
+		}
+		if IsSeeded(o.algorithm) {
+			deck.Seed = &seed
+		}
+		s, _ := NewShuffler(o.algorithm, seed)
+		deck.ShuffleWith(s)
 	}
 	return deck
 }
 
-func generateFullDeck() []Card {
-	suits := []string{"SPADES", "CLUBS", "DIAMONDS", "HEARTS"}
-	values := []string{"ACE", "2", "3", "4", "5", "6", "7", "8", "9", "10", "JACK", "QUEEN", "KING"}
+// jokers don't belong to any of the suits, so the suit tells the color instead
+var jokers = []Card{
+	{Value: "JOKER", Suit: "BLACK", Code: "X1"},
+	{Value: "JOKER", Suit: "RED", Code: "X2"},
+}
+
+func generateFullDeck(t DeckType) []Card {
+	copies := max(t.Copies, 1)
 	var cards []Card
 
-	for _, suit := range suits {
-		for _, value := range values {
+	for _, suit := range t.Suits {
+		for _, value := range t.Values {
 			c := Card{
 				Value: value,
 				Suit:  suit,
@@ -69,7 +350,9 @@ func generateFullDeck() []Card {
 			if value == "10" { // 10 is a special case, but could use TEN instead
 				c.Code = "10" + suit[:1]
 			}
-			cards = append(cards, c)
+			for i := 0; i < copies; i++ {
+				cards = append(cards, c)
+			}
 		}
 	}
 
@@ -77,8 +360,8 @@ func generateFullDeck() []Card {
 	return cards
 }
 
-func generateDeckFromCodes(codes []string) []Card {
-	fullDeck := generateFullDeck()
+func generateDeckFromCodes(t DeckType, codes []string) []Card {
+	fullDeck := append(generateFullDeck(t), jokers...)
 	var cards []Card
 
 	for _, code := range codes {
@@ -1,8 +1,12 @@
 package deck
 
 import (
-	"github.com/google/uuid"
+	"errors"
+	"math/rand"
+	"reflect"
 	"testing"
+
+	"github.com/google/uuid"
 )
 
 func TestNewDeckFullDeck(t *testing.T) {
@@ -85,3 +89,255 @@ func TestCardValidation(t *testing.T) {
 		}
 	}
 }
+
+func TestNewDeckWithJokers(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, nil, WithJokers(3))
+	if len(deck.Cards) != 55 {
+		t.Fatalf("Expected 55 cards in a deck with 3 jokers, got %d", len(deck.Cards))
+	}
+	want := []string{"X1", "X2", "X1"}
+	for i, code := range want {
+		card := deck.Cards[52+i]
+		if card.Code != code || card.Value != "JOKER" {
+			t.Errorf("Expected joker %s at position %d, got %+v", code, 52+i, card)
+		}
+	}
+}
+
+func TestNewDeckWithJokerCodes(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"X2", "AS", "X1"})
+	if len(deck.Cards) != 3 {
+		t.Fatalf("Expected 3 cards in deck, got %d", len(deck.Cards))
+	}
+	if deck.Cards[0].Suit != "RED" || deck.Cards[2].Suit != "BLACK" {
+		t.Errorf("Jokers have unexpected colors: %+v", deck.Cards)
+	}
+}
+
+func TestNewDeckShoe(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD"}, WithDecks(3), WithJokers(1))
+	if deck.Decks != 3 {
+		t.Errorf("Expected shoe of 3 decks, got %d", deck.Decks)
+	}
+	want := []string{"AS", "KD", "X1", "AS", "KD", "X1", "AS", "KD", "X1"}
+	if len(deck.Cards) != len(want) {
+		t.Fatalf("Expected %d cards in shoe, got %d", len(want), len(deck.Cards))
+	}
+	for i, code := range want {
+		if deck.Cards[i].Code != code {
+			t.Errorf("At position %d expected %s, got %s", i, code, deck.Cards[i].Code)
+		}
+	}
+}
+
+func TestNewDeckDefaultsToSingleDeck(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil)
+	if deck.Decks != 1 {
+		t.Errorf("Expected single deck by default, got %d", deck.Decks)
+	}
+}
+
+func TestSeededShuffleIsReproducible(t *testing.T) {
+	first := NewDeck(uuid.New(), true, nil, WithSeed(42))
+	second := NewDeck(uuid.New(), true, nil, WithSeed(42))
+	for i := range first.Cards {
+		if first.Cards[i] != second.Cards[i] {
+			t.Fatalf("Decks shuffled with the same seed differ at position %d", i)
+		}
+	}
+	if first.Seed == nil || *first.Seed != 42 {
+		t.Errorf("Expected seed 42 to be stored on the deck, got %v", first.Seed)
+	}
+
+	// math/rand sources are stable across releases, so a seed from a bug
+	// report must always yield the very same deal
+	want := []string{"KH", "JC", "9D", "3D", "10S", "8S", "10C", "6S"}
+	for i, code := range want {
+		if first.Cards[i].Code != code {
+			t.Errorf("At position %d expected %s, got %s", i, code, first.Cards[i].Code)
+		}
+	}
+}
+
+func TestShuffledDeckGetsRandomSeed(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil)
+	if deck.Seed == nil {
+		t.Fatal("Shuffled deck has no seed stored")
+	}
+
+	replay := NewDeck(uuid.New(), false, nil)
+	replay.ShuffleWithSource(rand.NewSource(*deck.Seed))
+	for i := range deck.Cards {
+		if deck.Cards[i] != replay.Cards[i] {
+			t.Fatalf("Replayed deal differs at position %d", i)
+		}
+	}
+
+	if unshuffled := NewDeck(uuid.New(), false, nil); unshuffled.Seed != nil {
+		t.Errorf("Unshuffled deck has seed %d stored", *unshuffled.Seed)
+	}
+}
+
+func TestDrawTracksDrawnCards(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH"})
+	deck.Draw(1)
+	deck.Draw(1)
+	if len(deck.Drawn) != 2 || deck.Drawn[0].Code != "AS" || deck.Drawn[1].Code != "KD" {
+		t.Errorf("Unexpected drawn cards: %v", deck.Drawn)
+	}
+}
+
+func TestReturnCards(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH", "2C"})
+	deck.Draw(3)
+
+	if err := deck.Return([]string{"QH", "AS"}); err != nil {
+		t.Fatalf("Return failed: %s", err)
+	}
+	want := []string{"2C", "QH", "AS"}
+	for i, code := range want {
+		if deck.Cards[i].Code != code {
+			t.Errorf("At position %d expected %s, got %s", i, code, deck.Cards[i].Code)
+		}
+	}
+	if len(deck.Drawn) != 1 || deck.Drawn[0].Code != "KD" {
+		t.Errorf("Unexpected drawn cards left: %v", deck.Drawn)
+	}
+}
+
+func TestReturnCardsNotDrawn(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH"})
+	deck.Draw(1)
+
+	for _, returned := range [][]string{{"KD"}, {"AS", "AS"}, {"AS", "GG"}} {
+		if err := deck.Return(returned); !errors.Is(err, ErrCardNotDrawn) {
+			t.Errorf("Return(%v) expected ErrCardNotDrawn, got %v", returned, err)
+		}
+	}
+	if len(deck.Cards) != 2 || len(deck.Drawn) != 1 {
+		t.Errorf("Failed returns changed the deck: cards=%v drawn=%v", deck.Cards, deck.Drawn)
+	}
+}
+
+func TestReturnAll(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, nil)
+	deck.Draw(10)
+	_ = deck.MoveToPile("hand", []string{"KH"})
+	_, _ = deck.DrawFromPile("hand", 1)
+
+	if returned := deck.ReturnAll(); len(returned) != 11 {
+		t.Errorf("Expected 11 cards to be returned, got %d", len(returned))
+	}
+	if len(deck.Cards) != 52 || len(deck.Drawn) != 0 {
+		t.Errorf("Expected full deck after returning everything, got %d cards and %d drawn", len(deck.Cards), len(deck.Drawn))
+	}
+}
+
+func TestDrawBottom(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH", "2C"})
+	drawn := deck.DrawBottom(2)
+	if len(drawn) != 2 || drawn[0].Code != "2C" || drawn[1].Code != "QH" {
+		t.Errorf("Expected cards from the bottom, got %v", drawn)
+	}
+	if len(deck.Cards) != 2 || deck.Cards[1].Code != "KD" {
+		t.Errorf("Unexpected cards left in deck: %v", deck.Cards)
+	}
+	if len(deck.DrawBottom(5)) != 2 || len(deck.Cards) != 0 {
+		t.Errorf("Expected DrawBottom to stop at the top of the deck")
+	}
+}
+
+func TestDrawRandom(t *testing.T) {
+	for _, algorithm := range Algorithms() {
+		t.Run(algorithm, func(t *testing.T) {
+			deck := NewDeck(uuid.New(), false, nil, WithAlgorithm(algorithm))
+			drawn := deck.DrawRandom(10)
+			if len(drawn) != 10 || len(deck.Cards) != 42 || len(deck.Drawn) != 10 {
+				t.Fatalf("Expected 10 cards drawn and 42 left, got %d and %d", len(drawn), len(deck.Cards))
+			}
+			seen := make(map[string]bool)
+			for _, card := range append(drawn, deck.Cards...) {
+				if seen[card.Code] {
+					t.Errorf("Card %s is both drawn and in the deck", card.Code)
+				}
+				seen[card.Code] = true
+			}
+		})
+	}
+}
+
+func TestDrawRandomUsesDeckAlgorithm(t *testing.T) {
+	crypto := shuffleAlgorithms[AlgorithmCrypto]
+	t.Cleanup(func() { shuffleAlgorithms[AlgorithmCrypto] = crypto })
+	picks := 0
+	counting := crypto
+	counting.picker = func(seed int64) func(n int) int {
+		pick := crypto.picker(seed)
+		return func(n int) int {
+			picks++
+			return pick(n)
+		}
+	}
+	shuffleAlgorithms[AlgorithmCrypto] = counting
+
+	deck := NewDeck(uuid.New(), false, nil, WithAlgorithm(AlgorithmCrypto))
+	deck.DrawRandom(3)
+	if picks != 3 {
+		t.Errorf("Expected 3 positions picked with crypto/rand, got %d", picks)
+	}
+}
+
+func TestDrawCodes(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH", "2C"})
+	drawn, err := deck.DrawCodes([]string{"QH", "AS"})
+	if err != nil {
+		t.Fatalf("DrawCodes failed: %s", err)
+	}
+	if drawn[0].Code != "QH" || drawn[1].Code != "AS" {
+		t.Errorf("Unexpected cards drawn: %v", drawn)
+	}
+	if len(deck.Cards) != 2 || deck.Cards[0].Code != "KD" || deck.Cards[1].Code != "2C" {
+		t.Errorf("Unexpected cards left in deck: %v", deck.Cards)
+	}
+
+	if _, err := deck.DrawCodes([]string{"KD", "QH"}); !errors.Is(err, ErrCardNotInDeck) {
+		t.Errorf("Expected ErrCardNotInDeck, got %v", err)
+	}
+	if len(deck.Cards) != 2 {
+		t.Errorf("Failed draw changed the deck: %v", deck.Cards)
+	}
+}
+
+func TestCloneSharesNothing(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil, WithSeed(42))
+	_ = deck.Commit()
+	deck.Draw(2)
+	_ = deck.MoveToPile("hand", []string{deck.Cards[0].Code})
+	_ = deck.Commit()
+
+	clone := deck.Clone()
+	if !reflect.DeepEqual(*deck, clone) {
+		t.Fatalf("Clone differs from the deck")
+	}
+
+	clone.Cards[0].Code = "X1"
+	clone.Drawn[0].Code = "X1"
+	clone.Piles["hand"][0].Code = "X1"
+	*clone.Seed = 0
+	clone.Commitment.Order[0] = "X1"
+	clone.PreviousCommitments[0].Order[0] = "X1"
+	clone.Events[0].Order[0] = "X1"
+	clone.Events[2].Positions[0] = 7
+	clone.Events[3].Cards[0] = "X1"
+	for _, c := range [][]Card{deck.Cards, deck.Drawn, deck.Piles["hand"]} {
+		if c[0].Code == "X1" {
+			t.Errorf("Changing the clone changed the cards of the deck")
+		}
+	}
+	if *deck.Seed != 42 || deck.Commitment.Order[0] == "X1" || deck.PreviousCommitments[0].Order[0] == "X1" {
+		t.Errorf("Changing the clone changed the seed or commitment of the deck")
+	}
+	if deck.Events[0].Order[0] == "X1" || deck.Events[2].Positions[0] == 7 || deck.Events[3].Cards[0] == "X1" {
+		t.Errorf("Changing the clone changed the events of the deck")
+	}
+}
@@ -0,0 +1,165 @@
+package deck
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrEventNotFound = errors.New("event not found")
+	// ErrIncompleteHistory is returned when replaying decks created before
+	// their events were recorded
+	ErrIncompleteHistory = errors.New("deck history is incomplete")
+)
+
+type EventType string
+
+const (
+	EventCreated  EventType = "created"
+	EventShuffled EventType = "shuffled"
+	EventDrawn    EventType = "drawn"
+	EventMoved    EventType = "moved"
+	EventReturned EventType = "returned"
+	EventClosed   EventType = "closed"
+	EventDeleted  EventType = "deleted"
+)
+
+// Event is a single change of a deck. Events carry everything needed to
+// replay them, so the deck can be rebuilt as it was after any of them
+type Event struct {
+	Index int       `json:"index"`
+	Type  EventType `json:"type"`
+	At    time.Time `json:"at"`
+	// Actor is whoever caused the event, storage fills it in from the request
+	Actor string `json:"actor,omitempty"`
+	// Cards are the codes of the cards drawn, moved or returned
+	Cards []string `json:"cards,omitempty"`
+	// Positions of the cards drawn from the deck, each one taken after the
+	// cards before it were taken out
+	Positions []int `json:"positions,omitempty"`
+	// Pile the cards were moved to or drawn from
+	Pile string `json:"pile,omitempty"`
+	// Order of the deck after it was created or shuffled
+	Order []string `json:"order,omitempty"`
+}
+
+func (d *Deck) record(e Event) {
+	e.Index = d.RecordedEvents + len(d.Events)
+	e.At = time.Now().UTC().Round(0)
+	// capping the capacity keeps decks sharing the events from seeing each other's
+	d.Events = append(d.Events[:len(d.Events):len(d.Events)], e)
+}
+
+func codesOf(cards []Card) []string {
+	codes := make([]string, 0, len(cards))
+	for _, card := range cards {
+		codes = append(codes, card.Code)
+	}
+	return codes
+}
+
+func cardsOf(codes []string) ([]Card, error) {
+	cards := make([]Card, 0, len(codes))
+	for _, code := range codes {
+		card, err := ParseCode(code)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+	return cards, nil
+}
+
+// TakeEvents removes the events from the deck and returns them, they count
+// as recorded from then on. Storage takes the events off the decks it
+// stores, so writing a deck never writes its whole history again
+func (d *Deck) TakeEvents() []Event {
+	events := d.Events
+	d.Events = nil
+	d.RecordedEvents += len(events)
+	return events
+}
+
+// Close stops the deck from dealing cards
+func (d *Deck) Close() {
+	d.Closed = true
+	d.record(Event{Type: EventClosed})
+}
+
+// MarkDeleted records the deletion of the deck, storage calls it when the
+// deck is deleted
+func (d *Deck) MarkDeleted() {
+	d.record(Event{Type: EventDeleted})
+}
+
+// AtEvent rebuilds the deck as it was right after the event with the given
+// index by replaying its events from creation, so the deck needs all of
+// them, like the one returned by DeckHistory
+func (d Deck) AtEvent(index int) (Deck, error) {
+	if index < 0 || index >= len(d.Events) {
+		return Deck{}, fmt.Errorf("%w: %d", ErrEventNotFound, index)
+	}
+	if d.RecordedEvents > 0 || d.Events[0].Type != EventCreated {
+		return Deck{}, ErrIncompleteHistory
+	}
+
+	replay := Deck{
+		ID:         d.ID,
+		Type:       d.Type,
+		Decks:      d.Decks,
+		Algorithm:  d.Algorithm,
+		Seed:       d.Seed,
+		Commitment: d.Commitment,
+		CreatedAt:  d.CreatedAt,
+		TTL:        d.TTL,
+	}
+	for _, e := range d.Events[:index+1] {
+		if err := replay.apply(e); err != nil {
+			return Deck{}, fmt.Errorf("replaying event %d: %w", e.Index, err)
+		}
+	}
+	replay.Events = d.Events[: index+1 : index+1]
+	return replay, nil
+}
+
+// apply replays the event, the events recorded while replaying are dropped
+// by AtEvent
+func (d *Deck) apply(e Event) error {
+	switch e.Type {
+	case EventCreated, EventShuffled:
+		cards, err := cardsOf(e.Order)
+		if err != nil {
+			return err
+		}
+		d.Cards = cards
+		d.Shuffled = e.Type == EventShuffled
+	case EventDrawn:
+		if e.Pile != "" {
+			_, err := d.DrawFromPile(e.Pile, len(e.Cards))
+			return err
+		}
+		return d.drawAt(e.Positions)
+	case EventMoved:
+		return d.MoveToPile(e.Pile, e.Cards)
+	case EventReturned:
+		return d.Return(e.Cards)
+	case EventClosed:
+		d.Closed = true
+	}
+	return nil
+}
+
+// drawAt draws the cards at the positions, in order
+func (d *Deck) drawAt(positions []int) error {
+	remaining := append([]Card(nil), d.Cards...)
+	for _, i := range positions {
+		if i < 0 || i >= len(remaining) {
+			return fmt.Errorf("%w: no card at position %d", ErrNotEnoughCards, i)
+		}
+		d.Drawn = append(d.Drawn, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	d.Cards = remaining
+	return nil
+}
@@ -0,0 +1,126 @@
+package deck
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// state copies the parts of the deck replay has to rebuild
+type state struct {
+	Cards    []string
+	Drawn    []string
+	Piles    map[string][]string
+	Shuffled bool
+	Closed   bool
+}
+
+func stateOf(d Deck) state {
+	s := state{
+		Cards:    codesOf(d.Cards),
+		Drawn:    codesOf(d.Drawn),
+		Shuffled: d.Shuffled,
+		Closed:   d.Closed,
+	}
+	if len(d.Piles) > 0 {
+		s.Piles = make(map[string][]string)
+		for name, pile := range d.Piles {
+			s.Piles[name] = codesOf(pile)
+		}
+	}
+	return s
+}
+
+func TestAtEventReplaysEveryStep(t *testing.T) {
+	// a shoe has duplicate cards, so replay must take the very same copies
+	d := NewDeck(uuid.New(), true, nil, WithDecks(2))
+	states := []state{stateOf(*d)}
+	steps := []func(){
+		func() { d.Draw(3) },
+		func() { d.DrawBottom(2) },
+		func() { d.DrawRandom(5) },
+		func() { _, _ = d.DrawCodes([]string{d.Cards[7].Code, d.Cards[3].Code}) },
+		func() { _ = d.MoveToPile("discard", []string{d.Cards[10].Code, d.Cards[0].Code}) },
+		func() { _, _ = d.DrawFromPile("discard", 1) },
+		func() { _ = d.Return([]string{d.Drawn[4].Code}) },
+		func() { d.ReturnAll() },
+		func() { d.Shuffle() },
+		func() { d.Close() },
+	}
+	for _, step := range steps {
+		before := len(d.Events)
+		step()
+		if len(d.Events) != before+1 {
+			t.Fatalf("Expected every step to record a single event, got %d", len(d.Events)-before)
+		}
+		states = append(states, stateOf(*d))
+	}
+
+	// the shuffle on creation is an event of its own
+	offset := 1
+	for i, expected := range states {
+		index := i + offset
+		replayed, err := d.AtEvent(index)
+		if err != nil {
+			t.Fatalf("AtEvent(%d) failed: %s", index, err)
+		}
+		if got := stateOf(replayed); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Deck after event %d (%s) does not match:\nexpected %+v\ngot      %+v", index, d.Events[index].Type, expected, got)
+		}
+		if len(replayed.Events) != index+1 {
+			t.Errorf("Expected replayed deck to have %d events, got %d", index+1, len(replayed.Events))
+		}
+	}
+
+	created, _ := d.AtEvent(0)
+	if created.Shuffled || len(created.Cards) != 104 {
+		t.Errorf("Expected unshuffled shoe of 104 cards after creation, got shuffled=%v with %d cards", created.Shuffled, len(created.Cards))
+	}
+}
+
+func TestAtEventErrors(t *testing.T) {
+	d := NewDeck(uuid.New(), false, nil)
+	if _, err := d.AtEvent(len(d.Events)); !errors.Is(err, ErrEventNotFound) {
+		t.Errorf("Expected ErrEventNotFound, got %v", err)
+	}
+
+	d.Events = d.Events[1:]
+	d.Draw(1)
+	if _, err := d.AtEvent(0); !errors.Is(err, ErrIncompleteHistory) {
+		t.Errorf("Expected ErrIncompleteHistory for deck without creation event, got %v", err)
+	}
+}
+
+func TestEventIndexes(t *testing.T) {
+	d := NewDeck(uuid.New(), false, nil)
+	d.Draw(1)
+	d.MarkDeleted()
+	expected := []EventType{EventCreated, EventDrawn, EventDeleted}
+	if len(d.Events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(d.Events))
+	}
+	for i, e := range d.Events {
+		if e.Index != i || e.Type != expected[i] || e.At.IsZero() {
+			t.Errorf("Unexpected event %d: %+v", i, e)
+		}
+	}
+}
+
+// events recorded after the deck's events were taken go on from the taken ones
+func TestTakeEvents(t *testing.T) {
+	d := NewDeck(uuid.New(), false, nil)
+	d.Draw(1)
+	if taken := d.TakeEvents(); len(taken) != 2 || d.Events != nil || d.RecordedEvents != 2 {
+		t.Fatalf("Expected 2 events to be taken, took %d and %d are left", len(taken), len(d.Events))
+	}
+
+	d.Draw(1)
+	if len(d.Events) != 1 || d.Events[0].Index != 2 {
+		t.Fatalf("Expected the next event to get index 2, got %+v", d.Events)
+	}
+	if _, err := d.AtEvent(0); !errors.Is(err, ErrIncompleteHistory) {
+		t.Errorf("Expected ErrIncompleteHistory for deck without its recorded events, got %v", err)
+	}
+}
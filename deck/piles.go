@@ -0,0 +1,88 @@
+package deck
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotEnoughCards = errors.New("not enough cards")
+	ErrCardNotInDeck  = errors.New("card is not in the deck")
+	ErrPileNotFound   = errors.New("pile not found")
+	ErrCardNotDrawn   = errors.New("card was not drawn from the deck")
+)
+
+// MoveToPile moves cards with the given codes from the deck onto the top of
+// the named pile, creating the pile if needed. Either all of the cards are
+// moved or, if any of them is missing from the deck, none of them
+func (d *Deck) MoveToPile(name string, codes []string) error {
+	remaining, taken, _, err := takeCodes(d.Cards, codes, ErrCardNotInDeck)
+	if err != nil {
+		return err
+	}
+	if d.Piles == nil {
+		d.Piles = make(map[string][]Card)
+	}
+	d.Cards = remaining
+	d.Piles[name] = append(d.Piles[name], taken...)
+	if len(taken) > 0 {
+		d.record(Event{Type: EventMoved, Cards: codesOf(taken), Pile: name})
+	}
+	return nil
+}
+
+func (d *Deck) Pile(name string) ([]Card, bool) {
+	pile, found := d.Piles[name]
+	return pile, found
+}
+
+// DrawFromPile draws n cards from the top of the pile, that is the cards
+// added last come out first. Drawing more cards than the pile has fails
+func (d *Deck) DrawFromPile(name string, n int) ([]Card, error) {
+	pile, found := d.Piles[name]
+	if !found {
+		return nil, fmt.Errorf("%w: %q", ErrPileNotFound, name)
+	}
+	if n > len(pile) {
+		return nil, fmt.Errorf("%w: pile %q has %d cards", ErrNotEnoughCards, name, len(pile))
+	}
+
+	drawn := make([]Card, 0, n)
+	for i := len(pile) - 1; i >= len(pile)-n; i-- {
+		drawn = append(drawn, pile[i])
+	}
+	// capping the capacity keeps later appends off the drawn cards
+	d.Piles[name] = pile[: len(pile)-n : len(pile)-n]
+	d.Drawn = append(d.Drawn, drawn...)
+	if n > 0 {
+		d.record(Event{Type: EventDrawn, Cards: codesOf(drawn), Pile: name})
+	}
+	return drawn, nil
+}
+
+// takeCodes removes the first card matching each code, in order, failing with
+// notFound for missing cards, and returns the positions the cards were taken
+// from. It builds new slices instead of changing cards, so failing halfway
+// leaves no trace
+func takeCodes(cards []Card, codes []string, notFound error) (remaining, taken []Card, positions []int, err error) {
+	remaining = append([]Card(nil), cards...)
+	for _, code := range codes {
+		i := indexOfCode(remaining, code)
+		if i < 0 {
+			return nil, nil, nil, fmt.Errorf("%w: %s", notFound, code)
+		}
+		taken = append(taken, remaining[i])
+		positions = append(positions, i)
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return remaining, taken, positions, nil
+}
+
+func indexOfCode(cards []Card, code string) int {
+	for i, card := range cards {
+		if card.Code == code {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,76 @@
+package deck
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func codes(cards []Card) []string {
+	var result []string
+	for _, card := range cards {
+		result = append(result, card.Code)
+	}
+	return result
+}
+
+func TestMoveToPile(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH", "2C"})
+	if err := deck.MoveToPile("discard", []string{"QH", "AS"}); err != nil {
+		t.Fatalf("MoveToPile failed: %s", err)
+	}
+	if got := codes(deck.Cards); len(got) != 2 || got[0] != "KD" || got[1] != "2C" {
+		t.Errorf("Unexpected cards left in deck: %v", got)
+	}
+	pile, found := deck.Pile("discard")
+	if !found {
+		t.Fatal("Pile was not created")
+	}
+	if got := codes(pile); len(got) != 2 || got[0] != "QH" || got[1] != "AS" {
+		t.Errorf("Unexpected cards in pile: %v", got)
+	}
+}
+
+func TestMoveToPileIsAllOrNothing(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD"})
+	err := deck.MoveToPile("hand", []string{"AS", "QH"})
+	if !errors.Is(err, ErrCardNotInDeck) {
+		t.Fatalf("Expected ErrCardNotInDeck, got %v", err)
+	}
+	if len(deck.Cards) != 2 || deck.Cards[0].Code != "AS" {
+		t.Errorf("Failed move changed the deck: %v", codes(deck.Cards))
+	}
+	if _, found := deck.Pile("hand"); found {
+		t.Errorf("Failed move created the pile")
+	}
+
+	// the same card can't be moved twice
+	err = deck.MoveToPile("hand", []string{"AS", "AS"})
+	if !errors.Is(err, ErrCardNotInDeck) {
+		t.Errorf("Expected ErrCardNotInDeck when moving a card twice, got %v", err)
+	}
+}
+
+func TestDrawFromPile(t *testing.T) {
+	deck := NewDeck(uuid.New(), false, []string{"AS", "KD", "QH"})
+	_ = deck.MoveToPile("discard", []string{"AS", "KD", "QH"})
+
+	drawn, err := deck.DrawFromPile("discard", 2)
+	if err != nil {
+		t.Fatalf("DrawFromPile failed: %s", err)
+	}
+	if got := codes(drawn); got[0] != "QH" || got[1] != "KD" {
+		t.Errorf("Expected cards from the top of the pile, got %v", got)
+	}
+	if pile, _ := deck.Pile("discard"); len(pile) != 1 || pile[0].Code != "AS" {
+		t.Errorf("Unexpected cards left in pile: %v", codes(pile))
+	}
+
+	if _, err := deck.DrawFromPile("discard", 2); !errors.Is(err, ErrNotEnoughCards) {
+		t.Errorf("Expected ErrNotEnoughCards, got %v", err)
+	}
+	if _, err := deck.DrawFromPile("missing", 1); !errors.Is(err, ErrPileNotFound) {
+		t.Errorf("Expected ErrPileNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package deck
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"sort"
+)
+
+const (
+	AlgorithmMath   = "math"
+	AlgorithmPCG    = "pcg"
+	AlgorithmCrypto = "crypto"
+
+	DefaultAlgorithm = AlgorithmMath
+)
+
+// Shuffler shuffles n elements with Fisher–Yates, calling swap to exchange
+// them. *rand.Rand from both math/rand and math/rand/v2 implement it
+type Shuffler interface {
+	Shuffle(n int, swap func(i, j int))
+}
+
+type shuffleAlgorithm struct {
+	// seeded algorithms produce the same order for the same seed
+	seeded bool
+	new    func(seed int64) Shuffler
+	// picker returns a func picking uniform numbers in [0, n), used for
+	// drawing cards at random positions
+	picker func(seed int64) func(n int) int
+}
+
+var shuffleAlgorithms = map[string]shuffleAlgorithm{
+	AlgorithmMath: {
+		seeded: true,
+		new: func(seed int64) Shuffler {
+			return rand.New(rand.NewSource(seed))
+		},
+		picker: func(seed int64) func(n int) int {
+			return rand.New(rand.NewSource(seed)).Intn
+		},
+	},
+	AlgorithmPCG: {
+		seeded: true,
+		new: func(seed int64) Shuffler {
+			return randv2.New(randv2.NewPCG(uint64(seed), 0))
+		},
+		picker: func(seed int64) func(n int) int {
+			return randv2.New(randv2.NewPCG(uint64(seed), 0)).IntN
+		},
+	},
+	AlgorithmCrypto: {
+		new: func(int64) Shuffler {
+			return CryptoShuffler{}
+		},
+		picker: func(int64) func(n int) int {
+			return func(n int) int {
+				return cryptoIntN(uint64(n))
+			}
+		},
+	},
+}
+
+// pickerFor returns a picker of the algorithm the deck was created with,
+// seeded algorithms get a fresh seed like reshuffles do
+func pickerFor(algorithm string) func(n int) int {
+	alg, found := shuffleAlgorithms[algorithm]
+	if !found {
+		alg = shuffleAlgorithms[DefaultAlgorithm]
+	}
+	return alg.picker(rand.Int63())
+}
+
+// NewShuffler returns a shuffler for the named algorithm. The seed is ignored
+// by algorithms which are not seeded
+func NewShuffler(algorithm string, seed int64) (Shuffler, error) {
+	alg, found := shuffleAlgorithms[algorithm]
+	if !found {
+		return nil, fmt.Errorf("unknown shuffle algorithm %q", algorithm)
+	}
+	return alg.new(seed), nil
+}
+
+// IsSeeded reports whether the algorithm is known and replays shuffles from a seed
+func IsSeeded(algorithm string) bool {
+	return shuffleAlgorithms[algorithm].seeded
+}
+
+// Algorithms returns sorted names of the supported shuffle algorithms
+func Algorithms() []string {
+	names := make([]string, 0, len(shuffleAlgorithms))
+	for name := range shuffleAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CryptoShuffler draws swap indices from crypto/rand. It can't be seeded, so
+// its shuffles can't be replayed
+type CryptoShuffler struct{}
+
+func (CryptoShuffler) Shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, cryptoIntN(uint64(i+1)))
+	}
+}
+
+// cryptoIntN returns a uniform number in [0, n). Taking a plain modulo of a
+// random uint64 favours small numbers, so values below 2^64 mod n are
+// rejected and the rest splits evenly into n buckets
+func cryptoIntN(n uint64) int {
+	threshold := -n % n
+	var buf [8]byte
+	for {
+		// crypto/rand failing means the system is broken beyond repair,
+		// dealing predictable cards is not an option
+		if _, err := crand.Read(buf[:]); err != nil {
+			panic(fmt.Sprintf("deck: reading crypto/rand: %s", err))
+		}
+		if v := binary.LittleEndian.Uint64(buf[:]); v >= threshold {
+			return int(v % n)
+		}
+	}
+}
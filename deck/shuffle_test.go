@@ -0,0 +1,95 @@
+package deck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// chi-squared goodness of fit over all 24 orders of a 4-card deck. With 23
+// degrees of freedom a statistic above 70 has a probability of about 1e-6
+// for a uniform shuffle, so the test is not flaky for crypto/rand either
+func TestShufflersAreUniform(t *testing.T) {
+	const (
+		orders    = 24
+		shuffles  = orders * 1000
+		threshold = 70.0
+	)
+
+	for _, alg := range Algorithms() {
+		t.Run(alg, func(t *testing.T) {
+			s, err := NewShuffler(alg, 42)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts := make(map[string]int)
+			for i := 0; i < shuffles; i++ {
+				deck := NewDeck(uuid.New(), false, []string{"AS", "2S", "3S", "4S"})
+				deck.ShuffleWith(s)
+				var order strings.Builder
+				for _, card := range deck.Cards {
+					order.WriteString(card.Code)
+				}
+				counts[order.String()]++
+			}
+
+			if len(counts) != orders {
+				t.Fatalf("Expected all %d orders to show up, got %d", orders, len(counts))
+			}
+			expected := float64(shuffles) / orders
+			var chi2 float64
+			for _, n := range counts {
+				diff := float64(n) - expected
+				chi2 += diff * diff / expected
+			}
+			if chi2 > threshold {
+				t.Errorf("Shuffles are not uniform, chi-squared statistic %.2f > %.2f", chi2, threshold)
+			}
+		})
+	}
+}
+
+func TestSeededAlgorithmsAreReproducible(t *testing.T) {
+	for _, alg := range []string{AlgorithmMath, AlgorithmPCG} {
+		t.Run(alg, func(t *testing.T) {
+			first := NewDeck(uuid.New(), true, nil, WithAlgorithm(alg), WithSeed(7))
+			second := NewDeck(uuid.New(), true, nil, WithAlgorithm(alg), WithSeed(7))
+			if first.Algorithm != alg {
+				t.Errorf("Expected algorithm %s stored on the deck, got %s", alg, first.Algorithm)
+			}
+			for i := range first.Cards {
+				if first.Cards[i] != second.Cards[i] {
+					t.Fatalf("Decks shuffled with the same seed differ at position %d", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCryptoShuffleHasNoSeed(t *testing.T) {
+	deck := NewDeck(uuid.New(), true, nil, WithAlgorithm(AlgorithmCrypto), WithSeed(7))
+	if deck.Seed != nil {
+		t.Errorf("Crypto shuffled deck has seed %d stored", *deck.Seed)
+	}
+	if !deck.Shuffled || len(deck.Cards) != 52 {
+		t.Errorf("Unexpected crypto shuffled deck: shuffled=%v cards=%d", deck.Shuffled, len(deck.Cards))
+	}
+}
+
+func TestCryptoIntNStaysInRange(t *testing.T) {
+	for _, n := range []uint64{1, 2, 3, 52, 1 << 63} {
+		for i := 0; i < 100; i++ {
+			if v := cryptoIntN(n); v < 0 || uint64(v) >= n {
+				t.Fatalf("cryptoIntN(%d) = %d is out of range", n, v)
+			}
+		}
+	}
+}
+
+func TestNewShufflerUnknownAlgorithm(t *testing.T) {
+	if _, err := NewShuffler("bogo", 0); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+}
@@ -0,0 +1,108 @@
+package deck
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const DefaultDeckType = "french"
+
+var frenchSuits = []string{"SPADES", "CLUBS", "DIAMONDS", "HEARTS"}
+
+var frenchDeckType = DeckType{
+	Name:   DefaultDeckType,
+	Suits:  frenchSuits,
+	Values: []string{"ACE", "2", "3", "4", "5", "6", "7", "8", "9", "10", "JACK", "QUEEN", "KING"},
+}
+
+// DeckType describes the cards making up a single base deck. Cards are
+// generated suit by suit, in the order of Suits and Values
+type DeckType struct {
+	Name   string
+	Suits  []string
+	Values []string
+	// Copies is how many times every card is present in the deck, pinochle
+	// for example uses two copies of each card. Zero means one copy
+	Copies int
+}
+
+var (
+	deckTypesMu sync.RWMutex
+	deckTypes   = make(map[string]DeckType)
+)
+
+func init() {
+	for _, t := range []DeckType{
+		frenchDeckType,
+		{
+			Name:   "piquet",
+			Suits:  frenchSuits,
+			Values: []string{"ACE", "7", "8", "9", "10", "JACK", "QUEEN", "KING"},
+		},
+		{
+			Name:   "skat",
+			Suits:  frenchSuits,
+			Values: []string{"ACE", "7", "8", "9", "10", "JACK", "QUEEN", "KING"},
+		},
+		{
+			Name:   "euchre",
+			Suits:  frenchSuits,
+			Values: []string{"ACE", "9", "10", "JACK", "QUEEN", "KING"},
+		},
+		{
+			Name:   "pinochle",
+			Suits:  frenchSuits,
+			Values: []string{"ACE", "9", "10", "JACK", "QUEEN", "KING"},
+			Copies: 2,
+		},
+		{
+			Name:   "durak",
+			Suits:  frenchSuits,
+			Values: []string{"ACE", "6", "7", "8", "9", "10", "JACK", "QUEEN", "KING"},
+		},
+	} {
+		RegisterDeckType(t)
+	}
+}
+
+// RegisterDeckType makes the deck type available by its name. Like
+// sql.Register it panics if the name is empty or already taken
+func RegisterDeckType(t DeckType) {
+	deckTypesMu.Lock()
+	defer deckTypesMu.Unlock()
+
+	if t.Name == "" {
+		panic("deck: RegisterDeckType with empty name")
+	}
+	if _, dup := deckTypes[t.Name]; dup {
+		panic(fmt.Sprintf("deck: RegisterDeckType called twice for %s", t.Name))
+	}
+	deckTypes[t.Name] = t
+}
+
+func LookupDeckType(name string) (DeckType, bool) {
+	deckTypesMu.RLock()
+	defer deckTypesMu.RUnlock()
+
+	t, found := deckTypes[name]
+	return t, found
+}
+
+// DeckTypes returns sorted names of all registered deck types
+func DeckTypes() []string {
+	deckTypesMu.RLock()
+	defer deckTypesMu.RUnlock()
+
+	names := make([]string, 0, len(deckTypes))
+	for name := range deckTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func defaultDeckType() DeckType {
+	t, _ := LookupDeckType(DefaultDeckType)
+	return t
+}
@@ -0,0 +1,93 @@
+package deck
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestBuiltinDeckTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		numCards int
+	}{
+		{"french", 52},
+		{"piquet", 32},
+		{"skat", 32},
+		{"euchre", 24},
+		{"pinochle", 48},
+		{"durak", 36},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dt, found := LookupDeckType(tc.name)
+			if !found {
+				t.Fatalf("Deck type %s is not registered", tc.name)
+			}
+			deck := NewDeck(uuid.New(), false, nil, WithType(dt))
+			if len(deck.Cards) != tc.numCards {
+				t.Errorf("Expected %d cards in %s deck, got %d", tc.numCards, tc.name, len(deck.Cards))
+			}
+			if deck.Type != tc.name {
+				t.Errorf("Expected deck type %s, got %s", tc.name, deck.Type)
+			}
+		})
+	}
+}
+
+func TestPinochleDeckHasTwoCopiesOfEachCard(t *testing.T) {
+	dt, _ := LookupDeckType("pinochle")
+	deck := NewDeck(uuid.New(), false, nil, WithType(dt))
+	counts := make(map[string]int)
+	for _, card := range deck.Cards {
+		counts[card.Code]++
+	}
+	if len(counts) != 24 {
+		t.Errorf("Expected 24 distinct cards in pinochle deck, got %d", len(counts))
+	}
+	for code, n := range counts {
+		if n != 2 {
+			t.Errorf("Expected 2 copies of %s, got %d", code, n)
+		}
+	}
+}
+
+func TestNewDeckCodesRespectDeckType(t *testing.T) {
+	dt, _ := LookupDeckType("euchre")
+	deck := NewDeck(uuid.New(), false, []string{"AS", "2S", "9H", "X1"}, WithType(dt))
+	if len(deck.Cards) != 3 {
+		t.Errorf("Expected cards outside of euchre deck to be ignored, got %v", deck.Cards)
+	}
+}
+
+// unregisterDeckType undoes RegisterDeckType, so tests can run more than once
+func unregisterDeckType(name string) {
+	deckTypesMu.Lock()
+	defer deckTypesMu.Unlock()
+	delete(deckTypes, name)
+}
+
+func TestRegisterDeckType(t *testing.T) {
+	t.Cleanup(func() { unregisterDeckType("test-aces") })
+	RegisterDeckType(DeckType{
+		Name:   "test-aces",
+		Suits:  []string{"SPADES", "HEARTS"},
+		Values: []string{"ACE"},
+	})
+	dt, found := LookupDeckType("test-aces")
+	if !found {
+		t.Fatal("Registered deck type not found")
+	}
+	deck := NewDeck(uuid.New(), false, nil, WithType(dt))
+	if len(deck.Cards) != 2 || deck.Cards[0].Code != "AS" || deck.Cards[1].Code != "AH" {
+		t.Errorf("Unexpected cards in custom deck: %v", deck.Cards)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering deck type twice did not panic")
+		}
+	}()
+	RegisterDeckType(dt)
+}
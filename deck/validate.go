@@ -0,0 +1,133 @@
+package deck
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+var ErrInvalidDeck = errors.New("invalid deck")
+
+// Validate checks a deck coming from outside the service, like an imported
+// one, and returns every problem found wrapped in ErrInvalidDeck.
+//
+// Cards are never added to or lost from a deck after creation, so a deck
+// with a creation event must hold exactly the cards it was created with.
+// Without one, no card may appear more often than the deck type and the
+// number of decks allow, with up to two jokers of each color per deck
+func (d Deck) Validate() error {
+	var problems []error
+	if d.ID == uuid.Nil {
+		problems = append(problems, errors.New("missing deck_id"))
+	}
+	t, found := LookupDeckType(d.Type)
+	if !found {
+		problems = append(problems, fmt.Errorf("unknown deck type %q", d.Type))
+	}
+	// listing orders decks by creation time
+	if d.CreatedAt.IsZero() {
+		problems = append(problems, errors.New("missing created_at"))
+	}
+	if d.Decks < 1 {
+		problems = append(problems, fmt.Errorf("number of decks must be positive, got %d", d.Decks))
+	}
+	if _, found := shuffleAlgorithms[d.Algorithm]; d.Algorithm != "" && !found {
+		problems = append(problems, fmt.Errorf("unknown shuffle algorithm %q", d.Algorithm))
+	}
+
+	counts := make(map[string]int)
+	check := func(where string, cards []Card) {
+		for i, card := range cards {
+			counts[card.Code]++
+			known, err := ParseCode(card.Code)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("%s card %d: %w", where, i, err))
+				continue
+			}
+			if known != card {
+				problems = append(problems, fmt.Errorf("%s card %d: %q is %s of %s, not %s of %s", where, i, card.Code, known.Value, known.Suit, card.Value, card.Suit))
+			}
+			if found {
+				for _, e := range ValidateCodes(t, []string{card.Code}) {
+					problems = append(problems, fmt.Errorf("%s card %d: %q: %w", where, i, card.Code, e.Err))
+				}
+			}
+		}
+	}
+	check("deck", d.Cards)
+	check("drawn", d.Drawn)
+	names := make([]string, 0, len(d.Piles))
+	for name := range d.Piles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		check(fmt.Sprintf("pile %q", name), d.Piles[name])
+	}
+
+	// storage indexes the history by the events
+	if d.RecordedEvents != 0 {
+		problems = append(problems, fmt.Errorf("recorded_events must be 0, the deck has to carry all its events, got %d", d.RecordedEvents))
+	}
+	for i, e := range d.Events {
+		if e.Index != i {
+			problems = append(problems, fmt.Errorf("event %d has index %d", i, e.Index))
+		}
+	}
+
+	if len(d.Events) > 0 && d.Events[0].Type == EventCreated {
+		created := make(map[string]int)
+		for _, code := range d.Events[0].Order {
+			created[code]++
+		}
+		problems = append(problems, compareCounts(counts, created)...)
+	} else if found && d.Decks > 0 {
+		allowed := make(map[string]int)
+		for _, card := range generateFullDeck(t) {
+			allowed[card.Code] += d.Decks
+		}
+		for _, joker := range jokers {
+			allowed[joker.Code] = 2 * d.Decks
+		}
+		for _, code := range sortedCodes(counts) {
+			if n := counts[code]; n > allowed[code] && allowed[code] > 0 {
+				problems = append(problems, fmt.Errorf("%d copies of %q, %d decks of type %s have at most %d", n, code, d.Decks, t.Name, allowed[code]))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidDeck, errors.Join(problems...))
+	}
+	return nil
+}
+
+// compareCounts reports every code held a different number of times than
+// the deck was created with
+func compareCounts(counts, created map[string]int) []error {
+	var problems []error
+	all := make(map[string]int)
+	for code := range counts {
+		all[code]++
+	}
+	for code := range created {
+		all[code]++
+	}
+	for _, code := range sortedCodes(all) {
+		if counts[code] != created[code] {
+			problems = append(problems, fmt.Errorf("deck holds %d copies of %q but was created with %d", counts[code], code, created[code]))
+		}
+	}
+	return problems
+}
+
+func sortedCodes(counts map[string]int) []string {
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
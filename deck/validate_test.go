@@ -0,0 +1,109 @@
+package deck
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestValidate(t *testing.T) {
+	played := func() Deck {
+		d := NewDeck(uuid.New(), true, nil, WithDecks(2), WithJokers(2))
+		d.Draw(3)
+		_ = d.MoveToPile("hand", []string{d.Cards[0].Code})
+		return d.Clone()
+	}
+
+	tests := []struct {
+		name  string
+		deck  func() Deck
+		valid bool
+	}{
+		{"Played Deck", played, true},
+		{"Custom Duplicates", func() Deck {
+			return *NewDeck(uuid.New(), false, []string{"AH", "AH", "AH"})
+		}, true},
+		{"Missing ID", func() Deck {
+			d := played()
+			d.ID = uuid.Nil
+			return d
+		}, false},
+		{"Missing Creation Time", func() Deck {
+			d := played()
+			d.CreatedAt = time.Time{}
+			return d
+		}, false},
+		{"Unknown Type", func() Deck {
+			d := played()
+			d.Type = "tarot"
+			return d
+		}, false},
+		{"Unknown Code", func() Deck {
+			d := played()
+			d.Cards[0] = Card{Value: "ACE", Suit: "STARS", Code: "A*"}
+			return d
+		}, false},
+		{"Card Not In Type", func() Deck {
+			d := *NewDeck(uuid.New(), false, nil, WithType(mustType("euchre")))
+			d.Events = nil
+			d.Cards[0] = Card{Value: "2", Suit: "SPADES", Code: "2S"}
+			return d
+		}, false},
+		{"Code Does Not Match Card", func() Deck {
+			d := played()
+			d.Drawn[0].Value = "KING"
+			d.Drawn[0].Code = "AS"
+			d.Drawn[0].Suit = "HEARTS"
+			return d
+		}, false},
+		{"Card Added After Creation", func() Deck {
+			d := played()
+			d.Piles["hand"] = append(d.Piles["hand"], Card{Value: "ACE", Suit: "SPADES", Code: "AS"})
+			return d
+		}, false},
+		{"Card Lost After Creation", func() Deck {
+			d := played()
+			d.Cards = d.Cards[1:]
+			return d
+		}, false},
+		{"Shoe Without History", func() Deck {
+			d := played()
+			d.Events = nil
+			return d
+		}, true},
+		{"Events Out Of Order", func() Deck {
+			d := played()
+			d.Events[0], d.Events[1] = d.Events[1], d.Events[0]
+			return d
+		}, false},
+		{"Events Left In Storage", func() Deck {
+			d := played()
+			d.TakeEvents()
+			return d
+		}, false},
+		{"Too Many Copies Without History", func() Deck {
+			d := *NewDeck(uuid.New(), false, []string{"AH", "AH", "AH"}, WithDecks(1))
+			d.Events = nil
+			return d
+		}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.deck().Validate()
+			if tc.valid && err != nil {
+				t.Errorf("Expected deck to be valid, got %s", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidDeck) {
+				t.Errorf("Expected ErrInvalidDeck, got %v", err)
+			}
+		})
+	}
+}
+
+func mustType(name string) DeckType {
+	t, _ := LookupDeckType(name)
+	return t
+}
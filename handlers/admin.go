@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/deck"
+	"deck-of-cards/storage"
+)
+
+// ExportFormatVersion is written on every exported line. Version 0, a line
+// without format_version, is a bare deck like the ones FileStorage keeps
+const ExportFormatVersion = 1
+
+// decks carry their whole history, so lines can get long
+const maxImportLine = 16 << 20
+
+// ExportLine is a single line of an export
+type ExportLine struct {
+	FormatVersion int             `json:"format_version"`
+	Deck          json.RawMessage `json:"deck"`
+}
+
+type ImportError struct {
+	Line   int    `json:"line"`
+	DeckID string `json:"deck_id,omitempty"`
+	Error  string `json:"error"`
+}
+
+type ImportResponse struct {
+	Imported int           `json:"imported"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// hasToken reports whether the request has the token in an
+// "Authorization: Bearer" header
+func hasToken(r *http.Request, token string) bool {
+	given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// RequireToken only lets through requests with the token in an
+// "Authorization: Bearer" header
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(r, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MetricsHandler serves the calls to every storage method counted by m as JSON
+func MetricsHandler(m *storage.Metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// streams all decks as newline-delimited JSON, a page of decks at a time
+func (h *Handler) HandleExport(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{"endpoint": "handleExport"})
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="decks.ndjson"`)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	filter := storage.ListFilter{Limit: storage.MaxListLimit}
+	exported, cursor := 0, ""
+	for {
+		page, err := h.st.List(r.Context(), filter, cursor)
+		if err != nil {
+			// the status is gone with the first line, so a failure can only cut the export short
+			log.WithError(err).WithField("exported", exported).Error("Error listing decks for export")
+			if exported == 0 {
+				http.Error(w, "Error listing decks", http.StatusInternalServerError)
+			}
+			return
+		}
+		for _, listed := range page.Decks {
+			// listed decks come without their events
+			d, err := h.st.DeckHistory(r.Context(), listed.ID)
+			if errors.Is(err, storage.ErrDeckNotFound) || (err == nil && deletedSinceListed(d)) {
+				continue
+			}
+			if err != nil {
+				log.WithError(err).WithField("deck_id", listed.ID).Error("Error reading deck history for export")
+				return
+			}
+			data, err := json.Marshal(d)
+			if err != nil {
+				log.WithError(err).WithField("deck_id", d.ID).Error("Error encoding deck for export")
+				return
+			}
+			if err := enc.Encode(ExportLine{FormatVersion: ExportFormatVersion, Deck: data}); err != nil {
+				log.WithError(err).Debug("Export was interrupted")
+				return
+			}
+			exported++
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	log.Debugf("Exported %d decks", exported)
+}
+
+// deletedSinceListed reports whether the deck is the last state of a deck
+// deleted after it was listed, which must not come back on import
+func deletedSinceListed(d deck.Deck) bool {
+	return len(d.Events) > 0 && d.Events[len(d.Events)-1].Type == deck.EventDeleted
+}
+
+// decodeExportLine reads a deck from a line of any format version
+func decodeExportLine(line []byte) (deck.Deck, error) {
+	var l ExportLine
+	if err := json.Unmarshal(line, &l); err != nil {
+		return deck.Deck{}, err
+	}
+	data := l.Deck
+	switch l.FormatVersion {
+	case 0:
+		data = line
+	case 1:
+		if len(data) == 0 {
+			return deck.Deck{}, errors.New("missing deck")
+		}
+	default:
+		return deck.Deck{}, fmt.Errorf("unsupported format_version %d, latest is %d", l.FormatVersion, ExportFormatVersion)
+	}
+	var d deck.Deck
+	if err := json.Unmarshal(data, &d); err != nil {
+		return deck.Deck{}, err
+	}
+	if l.FormatVersion == 0 {
+		// FileStorage keeps the history apart, bare decks come without it
+		d.RecordedEvents = 0
+	}
+	return d, nil
+}
+
+// bumpImportedVersion puts the version of an imported deck past the stored
+// deck with its ID, deleted or not, so versions never go backwards and
+// ETags handed out for the stored deck don't match the imported one
+func (h *Handler) bumpImportedVersion(r *http.Request, d *deck.Deck) error {
+	stored, err := h.st.DeckHistory(r.Context(), d.ID)
+	if errors.Is(err, storage.ErrDeckNotFound) {
+		return nil
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("deck_id", d.ID).Error("Error reading stored deck for import")
+		return errors.New("error reading deck from storage")
+	}
+	d.Version = max(d.Version, stored.Version+1)
+	return nil
+}
+
+// validates every deck of an export and saves the valid ones over the
+// stored decks with the same ID, reporting the rest line by line
+func (h *Handler) HandleImport(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{"endpoint": "handleImport"})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := ImportResponse{Errors: []ImportError{}}
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		d, err := decodeExportLine(scanner.Bytes())
+		if err == nil {
+			err = d.Validate()
+		}
+		if err == nil {
+			err = h.bumpImportedVersion(r, &d)
+		}
+		if err == nil {
+			// importing counts as use, so old decks aren't evicted right away
+			d.LastAccessedAt = time.Now().UTC().Round(0)
+			if err = h.st.SaveDeck(r.Context(), d); err != nil {
+				log.WithError(err).WithField("deck_id", d.ID).Error("Error saving imported deck")
+				err = errors.New("error saving deck in storage")
+			}
+		}
+		if err != nil {
+			importErr := ImportError{Line: line, Error: err.Error()}
+			if d.ID != uuid.Nil {
+				importErr.DeckID = d.ID.String()
+			}
+			response.Errors = append(response.Errors, importErr)
+			continue
+		}
+		response.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, bufio.ErrTooLong) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, fmt.Sprintf("Error reading import after %d decks: %s", response.Imported, err), status)
+		return
+	}
+	log.WithField("failed", len(response.Errors)).Infof("Imported %d decks", response.Imported)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+	"deck-of-cards/storage"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	source := NewHandler(storage.NewInMemoryStorage())
+	var ids []uuid.UUID
+	for i := 0; i < 3; i++ {
+		d := deck.NewDeck(uuid.New(), i%2 == 0, nil, deck.WithDecks(i+1))
+		d.Draw(i)
+		if err := source.st.SaveDeck(ctx, *d); err != nil {
+			t.Fatal("Error saving dummy deck in storage")
+		}
+		ids = append(ids, d.ID)
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/export", nil)
+	rr := httptest.NewRecorder()
+	source.HandleExport(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, rr.Code)
+	}
+	export := rr.Body.String()
+	if lines := strings.Count(export, "\n"); lines != len(ids) {
+		t.Fatalf("expected %d exported lines, got %d", len(ids), lines)
+	}
+
+	target := NewHandler(storage.NewInMemoryStorage())
+	req, _ = http.NewRequest("POST", "/admin/import", strings.NewReader(export))
+	rr = httptest.NewRecorder()
+	target.HandleImport(rr, req)
+	var response ImportResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response: %s", err)
+	}
+	if response.Imported != len(ids) || len(response.Errors) != 0 {
+		t.Fatalf("expected all %d decks imported, got %+v", len(ids), response)
+	}
+
+	for _, id := range ids {
+		exported, _ := source.st.DeckHistory(ctx, id)
+		imported, err := target.st.DeckHistory(ctx, id)
+		if err != nil {
+			t.Fatalf("Deck %v was not imported: %s", id, err)
+		}
+		imported.LastAccessedAt = exported.LastAccessedAt
+		if !reflect.DeepEqual(exported, imported) {
+			t.Errorf("Imported deck %v differs from the exported one", id)
+		}
+	}
+}
+
+func TestHandleImportReportsErrorsPerLine(t *testing.T) {
+	valid := deck.NewDeck(uuid.New(), true, nil)
+	bare, _ := json.Marshal(deck.NewDeck(uuid.New(), false, nil))
+	invalid := deck.NewDeck(uuid.New(), false, nil)
+	invalid.Cards = append(invalid.Cards, invalid.Cards[0])
+	line := func(version int, d *deck.Deck) string {
+		data, _ := json.Marshal(d)
+		out, _ := json.Marshal(ExportLine{FormatVersion: version, Deck: data})
+		return string(out)
+	}
+
+	body := strings.Join([]string{
+		line(ExportFormatVersion, valid),
+		"",
+		string(bare),
+		"{not json",
+		line(ExportFormatVersion+1, valid),
+		line(ExportFormatVersion, invalid),
+		`{"format_version": 1}`,
+	}, "\n")
+
+	h := NewHandler(storage.NewInMemoryStorage())
+	req, _ := http.NewRequest("POST", "/admin/import", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	h.HandleImport(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, rr.Code)
+	}
+	var response ImportResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("Error decoding response: %s", err)
+	}
+
+	if response.Imported != 2 {
+		t.Errorf("expected the current and the bare deck to be imported, got %d", response.Imported)
+	}
+	lines := make([]int, 0, len(response.Errors))
+	for _, e := range response.Errors {
+		lines = append(lines, e.Line)
+	}
+	if !reflect.DeepEqual(lines, []int{4, 5, 6, 7}) {
+		t.Errorf("expected errors on lines 4 to 7, got %+v", response.Errors)
+	}
+	if len(response.Errors) == 4 && response.Errors[2].DeckID != invalid.ID.String() {
+		t.Errorf("expected the invalid deck to be reported with its ID, got %+v", response.Errors[2])
+	}
+	if _, found := h.st.GetDeck(context.Background(), invalid.ID); found {
+		t.Errorf("expected the invalid deck not to be saved")
+	}
+}
+
+// imported decks never go back to a version, or the ETag of it, which
+// was handed out for the stored deck
+func TestHandleImportMovesVersionsForward(t *testing.T) {
+	ctx := context.Background()
+	h := NewHandler(storage.NewInMemoryStorage())
+	stored := func(deleted bool) deck.Deck {
+		d := deck.NewDeck(uuid.New(), false, nil)
+		if err := h.st.SaveDeck(ctx, *d); err != nil {
+			t.Fatalf("SaveDeck failed: %s", err)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := h.st.MutateDeck(ctx, d.ID, func(d *deck.Deck) error { return nil }); err != nil {
+				t.Fatalf("MutateDeck failed: %s", err)
+			}
+		}
+		if deleted {
+			if err := h.st.DeleteDeck(ctx, d.ID); err != nil {
+				t.Fatalf("DeleteDeck failed: %s", err)
+			}
+		}
+		return *d
+	}
+
+	tests := []struct {
+		name     string
+		deck     deck.Deck
+		version  int64
+		expected int64
+	}{
+		{"Older Than Stored", stored(false), 1, 5},
+		{"Newer Than Stored", stored(false), 10, 10},
+		{"Older Than Deleted", stored(true), 0, 5},
+		{"New Deck", *deck.NewDeck(uuid.New(), false, nil), 2, 2},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.deck.Version = tc.version
+			data, _ := json.Marshal(tc.deck)
+			line, _ := json.Marshal(ExportLine{FormatVersion: ExportFormatVersion, Deck: data})
+			req, _ := http.NewRequest("POST", "/admin/import", bytes.NewReader(line))
+			rr := httptest.NewRecorder()
+			h.HandleImport(rr, req)
+
+			d, found := h.st.GetDeck(ctx, tc.deck.ID)
+			if !found {
+				t.Fatalf("expected the deck to be imported, got %s", rr.Body.String())
+			}
+			if d.Version != tc.expected {
+				t.Errorf("expected version %d, got %d", tc.expected, d.Version)
+			}
+		})
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	handler := RequireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name           string
+		authorization  string
+		expectedStatus int
+	}{
+		{"Valid Token", "Bearer secret", http.StatusNoContent},
+		{"Wrong Token", "Bearer guess", http.StatusUnauthorized},
+		{"Missing Token", "", http.StatusUnauthorized},
+		{"Basic Auth", "Basic c2VjcmV0", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/export", bytes.NewReader(nil))
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := storage.NewMetrics()
+	st := storage.Chain(storage.NewInMemoryStorage(), storage.Instrument(m))
+	st.GetDeck(context.Background(), uuid.New())
+
+	req, _ := http.NewRequest("GET", "/admin/metrics", nil)
+	rr := httptest.NewRecorder()
+	MetricsHandler(m).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %v, got %v", http.StatusOK, rr.Code)
+	}
+	var stats map[string]storage.MethodStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatalf("Error decoding response: %s", err)
+	}
+	if stats["GetDeck"].Calls != 1 {
+		t.Errorf("Expected a single GetDeck call, got %+v", stats)
+	}
+}
@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -14,15 +18,52 @@ import (
 	"deck-of-cards/storage"
 )
 
+const (
+	maxJokers = 4
+	maxDecks  = 8
+
+	drawFromTop    = "top"
+	drawFromBottom = "bottom"
+	drawFromRandom = "random"
+)
+
+var (
+	errPreconditionFailed = errors.New("deck version does not match If-Match")
+	errDeckClosed         = errors.New("deck is closed")
+	// the order the deck committed to says nothing about cards the server
+	// picks out of it, so committed decks only deal from the top or bottom
+	errUncommittedDraw = errors.New("draw is not covered by the deck commitment")
+)
+
 type DeckResponse struct {
-	DeckID    string `json:"deck_id"`
-	Shuffled  bool   `json:"shuffled"`
-	Remaining int    `json:"remaining"`
+	DeckID     string `json:"deck_id"`
+	Shuffled   bool   `json:"shuffled"`
+	Remaining  int    `json:"remaining"`
+	Decks      int    `json:"decks"`
+	Seed       *int64 `json:"seed,omitempty"`
+	Commitment string `json:"commitment,omitempty"`
 }
 
 type OpenDeckResponse struct {
+	DeckID    string                 `json:"deck_id"`
+	Shuffled  bool                   `json:"shuffled"`
+	Remaining int                    `json:"remaining"`
+	Type      string                 `json:"type"`
+	Decks     int                    `json:"decks"`
+	Algorithm string                 `json:"algorithm,omitempty"`
+	Seed      *int64                 `json:"seed,omitempty"`
+	Closed    bool                   `json:"closed"`
+	Piles     map[string]PileSummary `json:"piles,omitempty"`
+	Cards     []deck.Card            `json:"cards"`
+}
+
+type PileSummary struct {
+	Remaining int `json:"remaining"`
+}
+
+type PileResponse struct {
 	DeckID    string      `json:"deck_id"`
-	Shuffled  bool        `json:"shuffled"`
+	Pile      string      `json:"pile"`
 	Remaining int         `json:"remaining"`
 	Cards     []deck.Card `json:"cards"`
 }
@@ -31,18 +72,211 @@ type DrawResponse struct {
 	Cards []deck.Card `json:"cards"`
 }
 
+type RevealResponse struct {
+	DeckID     string   `json:"deck_id"`
+	Commitment string   `json:"commitment"`
+	Salt       string   `json:"salt"`
+	Order      []string `json:"order"`
+	// Previous are the commitments made before the deck was returned to or
+	// reshuffled, oldest first
+	Previous []deck.Commitment `json:"previous,omitempty"`
+}
+
+type DeckSummary struct {
+	DeckID    string    `json:"deck_id"`
+	Shuffled  bool      `json:"shuffled"`
+	Remaining int       `json:"remaining"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ListDecksResponse struct {
+	Decks      []DeckSummary `json:"decks"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+type DeckEventsResponse struct {
+	DeckID string       `json:"deck_id"`
+	Events []deck.Event `json:"events"`
+}
+
+type DeckAtEventResponse struct {
+	Event deck.Event       `json:"event"`
+	Deck  OpenDeckResponse `json:"deck"`
+}
+
+type RejectedCode struct {
+	Position int    `json:"position"`
+	Code     string `json:"code"`
+	Reason   string `json:"reason"`
+}
+
+type ErrorResponse struct {
+	Error    string         `json:"error"`
+	Rejected []RejectedCode `json:"rejected,omitempty"`
+}
+
 type Handler struct {
-	st      storage.DeckStorage
-	uuidGen func() uuid.UUID
+	st         storage.DeckStorage
+	uuidGen    func() uuid.UUID
+	adminToken string
 }
 
-func NewHandler(st storage.DeckStorage) *Handler {
-	return &Handler{
+// Option tweaks the way NewHandler builds the handler
+type Option func(*Handler)
+
+// WithAdminToken sets the token admins send as a Bearer token. Seeds are
+// only returned to admins, so without a token they are never returned
+func WithAdminToken(token string) Option {
+	return func(h *Handler) {
+		h.adminToken = token
+	}
+}
+
+func NewHandler(st storage.DeckStorage, opts ...Option) *Handler {
+	h := &Handler{
 		st: st,
 		uuidGen: func() uuid.UUID {
 			return uuid.New()
 		},
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// fromAdmin reports whether the request carries the admin token. Admins get
+// more out of some responses than players, so caches have to keep them apart
+// by the Authorization header, which is why it has to be called before the
+// headers are written
+func (h *Handler) fromAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if h.adminToken == "" {
+		return false
+	}
+	w.Header().Set("Vary", "Authorization")
+	return hasToken(r, h.adminToken)
+}
+
+// seedFor returns the seed of the deck if the request comes from an admin.
+// Anyone holding the seed can work out the order of a deck, so it's kept
+// from players
+func (h *Handler) seedFor(w http.ResponseWriter, r *http.Request, d deck.Deck) *int64 {
+	if !h.fromAdmin(w, r) {
+		return nil
+	}
+	return d.Seed
+}
+
+// eventsFor returns the events the way the request may see them, actors are
+// only shown to admins
+func (h *Handler) eventsFor(w http.ResponseWriter, r *http.Request, events []deck.Event) []deck.Event {
+	if h.fromAdmin(w, r) {
+		return events
+	}
+	hidden := make([]deck.Event, len(events))
+	for i, e := range events {
+		e.Actor = ""
+		hidden[i] = e
+	}
+	return hidden
+}
+
+// versions are unique per deck, so the version alone makes a strong ETag
+func deckETag(d deck.Deck) string {
+	return fmt.Sprintf(`"%d"`, d.Version)
+}
+
+// checks an If-Match or If-None-Match header value against the etag.
+// If-None-Match uses weak comparison, so W/ prefixes are ignored there
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+var pileNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// parses the {name} path value, writing the error response when it's not a valid pile name
+func parsePileName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := r.PathValue("name")
+	if !pileNameRe.MatchString(name) {
+		http.Error(w, "Invalid pile name", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
+
+func pileSummaries(d deck.Deck) map[string]PileSummary {
+	if len(d.Piles) == 0 {
+		return nil
+	}
+	piles := make(map[string]PileSummary, len(d.Piles))
+	for name, cards := range d.Piles {
+		piles[name] = PileSummary{Remaining: len(cards)}
+	}
+	return piles
+}
+
+// parses the {id} path value, writing the error response when it's not a deck ID
+func parseDeckID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	deckIDParam := r.PathValue("id")
+	if deckIDParam == "" {
+		http.Error(w, "Missing deck ID", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+
+	deckID, err := uuid.Parse(deckIDParam)
+	if err != nil {
+		http.Error(w, "Invalid deck ID", http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	return deckID, true
+}
+
+// writes the response for errors shared by all endpoints changing decks
+func writeDeckError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrDeckGone):
+		http.Error(w, "Deck was deleted", http.StatusGone)
+	case errors.Is(err, storage.ErrDeckNotFound):
+		http.Error(w, "Deck not found", http.StatusNotFound)
+	case errors.Is(err, errDeckClosed):
+		http.Error(w, "Deck is closed", http.StatusConflict)
+	default:
+		http.Error(w, "Error updating deck in storage", http.StatusInternalServerError)
+	}
+}
+
+// recently deleted decks are reported as gone rather than not found
+func (h *Handler) writeDeckNotFound(w http.ResponseWriter, r *http.Request, id uuid.UUID) {
+	if h.st.DeckDeleted(r.Context(), id) {
+		http.Error(w, "Deck was deleted", http.StatusGone)
+		return
+	}
+	http.Error(w, "Deck not found", http.StatusNotFound)
+}
+
+func writeRejectedCodes(w http.ResponseWriter, rejected []*deck.CodeError) {
+	response := ErrorResponse{Error: "Invalid card codes"}
+	for _, r := range rejected {
+		response.Rejected = append(response.Rejected, RejectedCode{
+			Position: r.Position,
+			Code:     r.Code,
+			Reason:   r.Err.Error(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logrus.WithError(err).Error("Error encoding rejected card codes")
+	}
 }
 
 func parseCardCodes(cardsParam string) []string {
@@ -65,26 +299,97 @@ func (h *Handler) HandleCreateDeck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	shuffle := r.URL.Query().Get("shuffle") == "true"
+	strict := r.URL.Query().Get("strict") == "true"
 	cardsParam := r.URL.Query().Get("cards")
 	cardCodes := parseCardCodes(cardsParam)
+
+	dt, _ := deck.LookupDeckType(deck.DefaultDeckType)
+	if typeParam := r.URL.Query().Get("type"); typeParam != "" {
+		var found bool
+		if dt, found = deck.LookupDeckType(typeParam); !found {
+			http.Error(w, "Unknown deck type", http.StatusBadRequest)
+			return
+		}
+	}
+	opts := []deck.Option{deck.WithType(dt)}
+	if strict {
+		if rejected := deck.ValidateCodes(dt, cardCodes); len(rejected) > 0 {
+			log.Debugf("Rejecting %d card codes in strict mode", len(rejected))
+			writeRejectedCodes(w, rejected)
+			return
+		}
+	}
+	if jokersParam := r.URL.Query().Get("jokers"); jokersParam != "" {
+		jokers, err := strconv.Atoi(jokersParam)
+		if err != nil || jokers < 0 || jokers > maxJokers {
+			http.Error(w, "Invalid number of jokers", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, deck.WithJokers(jokers))
+	}
+	if decksParam := r.URL.Query().Get("decks"); decksParam != "" {
+		decks, err := strconv.Atoi(decksParam)
+		if err != nil || decks < 1 || decks > maxDecks {
+			http.Error(w, "Invalid number of decks", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, deck.WithDecks(decks))
+	}
+	if ttlParam := r.URL.Query().Get("ttl"); ttlParam != "" {
+		ttl, err := time.ParseDuration(ttlParam)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "Invalid ttl", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, deck.WithTTL(ttl))
+	}
+	algorithm := deck.DefaultAlgorithm
+	if algorithmParam := r.URL.Query().Get("algorithm"); algorithmParam != "" {
+		if _, err := deck.NewShuffler(algorithmParam, 0); err != nil {
+			http.Error(w, "Unknown shuffle algorithm", http.StatusBadRequest)
+			return
+		}
+		algorithm = algorithmParam
+		opts = append(opts, deck.WithAlgorithm(algorithm))
+	}
+	if seedParam := r.URL.Query().Get("seed"); seedParam != "" {
+		seed, err := strconv.ParseInt(seedParam, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid seed", http.StatusBadRequest)
+			return
+		}
+		if !deck.IsSeeded(algorithm) {
+			http.Error(w, "Shuffle algorithm does not support seeds", http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, deck.WithSeed(seed))
+	}
 	log.Debugf("Request to create a new deck shuffle=%v cards=%v", shuffle, cardsParam)
 
 	id := h.uuidGen()
-	d := deck.NewDeck(id, shuffle, cardCodes)
+	d := deck.NewDeck(id, shuffle, cardCodes, opts...)
+	if err := d.Commit(); err != nil {
+		log.WithError(err).Error("Error committing to deck order")
+		http.Error(w, "Error creating deck", http.StatusInternalServerError)
+		return
+	}
 	err := h.st.SaveDeck(r.Context(), *d)
 	if err != nil {
 		http.Error(w, "Error saving created deck", http.StatusInternalServerError)
+		return
 	}
 	log.WithField("deck_id", d.ID).Debugf("Saving new deck")
+	response := DeckResponse{
+		DeckID:     d.ID.String(),
+		Shuffled:   d.Shuffled,
+		Remaining:  len(d.Cards),
+		Decks:      d.Decks,
+		Seed:       h.seedFor(w, r, *d),
+		Commitment: d.Commitment.Hash,
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Location", "/decks/"+d.ID.String())
 	w.WriteHeader(http.StatusCreated)
-
-	response := DeckResponse{
-		DeckID:    d.ID.String(),
-		Shuffled:  d.Shuffled,
-		Remaining: len(d.Cards),
-	}
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -102,37 +407,49 @@ func (h *Handler) HandleOpenDeck(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if deckIDParam == "" {
-		http.Error(w, "Missing deck ID", http.StatusBadRequest)
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
 		return
 	}
 
-	deckID, err := uuid.Parse(deckIDParam)
-	if err != nil {
-		http.Error(w, "Invalid deck ID", http.StatusBadRequest)
+	d, found := h.st.GetDeck(r.Context(), deckID)
+	if !found {
+		h.writeDeckNotFound(w, r, deckID)
 		return
 	}
 
-	d, found := h.st.GetDeck(r.Context(), deckID)
-	if !found {
-		http.Error(w, fmt.Sprintf("Deck not found: %s", err), http.StatusNotFound)
+	seed := h.seedFor(w, r, d)
+	etag := deckETag(d)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	log.Debug("Opening deck")
 
-	response := OpenDeckResponse{
-		DeckID:    deckID.String(),
-		Shuffled:  d.Shuffled,
-		Remaining: len(d.Cards),
-		Cards:     d.Cards,
-	}
+	response := openDeckResponse(d)
+	response.Seed = seed
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+func openDeckResponse(d deck.Deck) OpenDeckResponse {
+	return OpenDeckResponse{
+		DeckID:    d.ID.String(),
+		Shuffled:  d.Shuffled,
+		Remaining: len(d.Cards),
+		Type:      d.Type,
+		Decks:     d.Decks,
+		Algorithm: d.Algorithm,
+		Closed:    d.Closed,
+		Piles:     pileSummaries(d),
+		Cards:     d.Cards,
+	}
+}
+
 // fetches the deck from the DeckStorage, draws cards, updates deck
 func (h *Handler) HandleDrawCards(w http.ResponseWriter, r *http.Request) {
 	deckIDParam := r.PathValue("id")
@@ -145,44 +462,635 @@ func (h *Handler) HandleDrawCards(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if deckIDParam == "" {
-		http.Error(w, "Missing deck ID", http.StatusBadRequest)
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
 		return
 	}
 
-	deckID, err := uuid.Parse(deckIDParam)
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = drawFromTop
+	}
+	if from != drawFromTop && from != drawFromBottom && from != drawFromRandom {
+		http.Error(w, "Invalid draw position", http.StatusBadRequest)
+		return
+	}
+
+	// specific cards are pulled out of the deck wherever they are, so they
+	// don't need count or from
+	cardCodes := parseCardCodes(r.URL.Query().Get("cards"))
+	var numCards int
+	if len(cardCodes) > 0 {
+		if r.URL.Query().Has("from") {
+			http.Error(w, "Drawing specific cards can't be combined with from", http.StatusBadRequest)
+			return
+		}
+		numCards = len(cardCodes)
+	} else {
+		var err error
+		numCards, err = strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || numCards < 1 {
+			http.Error(w, "Invalid number of cards", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+
+	log.Debugf("Drawing count=%v cards=%v from=%v deck", numCards, cardCodes, from)
+	var drawnCards []deck.Card
+	d, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		if ifMatch != "" && !etagMatches(ifMatch, deckETag(*d), false) {
+			return errPreconditionFailed
+		}
+		if d.Closed {
+			return errDeckClosed
+		}
+		if d.Commitment != nil && (len(cardCodes) > 0 || from == drawFromRandom) {
+			return errUncommittedDraw
+		}
+		if len(cardCodes) > 0 {
+			var err error
+			drawnCards, err = d.DrawCodes(cardCodes)
+			return err
+		}
+		if numCards > len(d.Cards) {
+			return deck.ErrNotEnoughCards
+		}
+		switch from {
+		case drawFromBottom:
+			drawnCards = d.DrawBottom(numCards)
+		case drawFromRandom:
+			drawnCards = d.DrawRandom(numCards)
+		default:
+			drawnCards = d.Draw(numCards)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errPreconditionFailed):
+		http.Error(w, "Deck was modified", http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, deck.ErrNotEnoughCards):
+		http.Error(w, "Not enough cards in the deck", http.StatusBadRequest)
+		return
+	case errors.Is(err, deck.ErrCardNotInDeck):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errUncommittedDraw):
+		http.Error(w, "Deck is committed to its order, draw from the top or bottom", http.StatusConflict)
+		return
+	case err != nil:
+		writeDeckError(w, err)
+		return
+	}
+	log.Debugf("Deck updated, new card count=%v", len(d.Cards))
+
+	response := DrawResponse{Cards: drawnCards}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", deckETag(d))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// closes the deck, so it no longer deals cards and its commitment can be revealed
+func (h *Handler) HandleCloseDeck(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleCloseDeck",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		d.Close()
+		return nil
+	})
 	if err != nil {
-		http.Error(w, "Invalid deck ID", http.StatusBadRequest)
+		writeDeckError(w, err)
 		return
 	}
+	log.Debug("Deck closed")
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	ctx := r.Context()
-	d, found := h.st.GetDeck(ctx, deckID)
+// reveals the salt and the original order of an exhausted or closed deck,
+// so players can verify the commitment returned on creation
+func (h *Handler) HandleRevealDeck(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleRevealDeck",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+
+	d, found := h.st.GetDeck(r.Context(), deckID)
 	if !found {
-		http.Error(w, "Deck not found", http.StatusNotFound)
+		h.writeDeckNotFound(w, r, deckID)
 		return
 	}
+	if d.Commitment == nil {
+		http.Error(w, "Deck has no commitment", http.StatusNotFound)
+		return
+	}
+	if !d.Closed && len(d.Cards) > 0 {
+		http.Error(w, "Deck is still in play", http.StatusConflict)
+		return
+	}
+
+	log.Debug("Revealing deck commitment")
+
+	response := RevealResponse{
+		DeckID:     d.ID.String(),
+		Commitment: d.Commitment.Hash,
+		Salt:       d.Commitment.Salt,
+		Order:      d.Commitment.Order,
+		Previous:   d.PreviousCommitments,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	numCardsParam := r.URL.Query().Get("count")
-	numCards, err := strconv.Atoi(numCardsParam)
+// moves cards from the deck onto a pile, all of them or none
+func (h *Handler) HandleAddToPile(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleAddToPile",
+		"deck_id":  r.PathValue("id"),
+		"pile":     r.PathValue("name"),
+	})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+	name, ok := parsePileName(w, r)
+	if !ok {
+		return
+	}
+	cardCodes := parseCardCodes(r.URL.Query().Get("cards"))
+	if len(cardCodes) == 0 {
+		http.Error(w, "Missing cards", http.StatusBadRequest)
+		return
+	}
+
+	log.Debugf("Moving cards=%v to pile", cardCodes)
+	d, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		if d.Closed {
+			return errDeckClosed
+		}
+		return d.MoveToPile(name, cardCodes)
+	})
+	switch {
+	case errors.Is(err, deck.ErrCardNotInDeck):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		writeDeckError(w, err)
+		return
+	}
+
+	writePile(w, d, name)
+}
+
+// lists the cards of a pile without changing it
+func (h *Handler) HandleOpenPile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+	name, ok := parsePileName(w, r)
+	if !ok {
+		return
+	}
+
+	d, found := h.st.GetDeck(r.Context(), deckID)
+	if !found {
+		h.writeDeckNotFound(w, r, deckID)
+		return
+	}
+	if _, found := d.Pile(name); !found {
+		http.Error(w, "Pile not found", http.StatusNotFound)
+		return
+	}
+
+	writePile(w, d, name)
+}
+
+// draws cards from the top of a pile
+func (h *Handler) HandleDrawFromPile(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleDrawFromPile",
+		"deck_id":  r.PathValue("id"),
+		"pile":     r.PathValue("name"),
+	})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+	name, ok := parsePileName(w, r)
+	if !ok {
+		return
+	}
+	numCards, err := strconv.Atoi(r.URL.Query().Get("count"))
 	if err != nil || numCards < 1 {
 		http.Error(w, "Invalid number of cards", http.StatusBadRequest)
 		return
 	}
-	if numCards > len(d.Cards) {
-		http.Error(w, "Not enough cards in the deck", http.StatusBadRequest)
+
+	log.Debugf("Drawing count=%v cards from pile", numCards)
+	var drawnCards []deck.Card
+	d, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		if d.Closed {
+			return errDeckClosed
+		}
+		var err error
+		drawnCards, err = d.DrawFromPile(name, numCards)
+		return err
+	})
+	switch {
+	case errors.Is(err, deck.ErrPileNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, deck.ErrNotEnoughCards):
+		http.Error(w, "Not enough cards in the pile", http.StatusBadRequest)
+		return
+	case err != nil:
+		writeDeckError(w, err)
+		return
+	}
+
+	response := DrawResponse{Cards: drawnCards}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", deckETag(d))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// puts drawn cards back to the bottom of the deck, the listed ones or all of them
+func (h *Handler) HandleReturnCards(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleReturnCards",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
 		return
 	}
+	cardCodes := parseCardCodes(r.URL.Query().Get("cards"))
 
-	log.Debugf("Drawing count=%v cards from deck", numCards)
-	drawnCards := d.Draw(numCards)
-	err = h.st.UpdateDeck(ctx, d)
+	log.Debugf("Returning cards=%v to deck", cardCodes)
+	d, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		if d.Closed {
+			return errDeckClosed
+		}
+		if len(cardCodes) == 0 {
+			if len(d.ReturnAll()) == 0 {
+				return nil
+			}
+		} else if err := d.Return(cardCodes); err != nil {
+			return err
+		}
+		return recommit(d)
+	})
+	switch {
+	case errors.Is(err, deck.ErrCardNotDrawn):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		writeDeckError(w, err)
+		return
+	}
+
+	writeDeck(w, d)
+}
+
+// shuffles the deck, returning all drawn cards to it first unless remaining_only=true
+func (h *Handler) HandleShuffleDeck(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleShuffleDeck",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+	remainingOnly := r.URL.Query().Get("remaining_only") == "true"
+
+	log.Debugf("Shuffling deck remaining_only=%v", remainingOnly)
+	d, err := h.st.MutateDeck(r.Context(), deckID, func(d *deck.Deck) error {
+		if d.Closed {
+			return errDeckClosed
+		}
+		if !remainingOnly {
+			d.ReturnAll()
+		}
+		d.ShuffleWith(reshuffler(*d))
+		return recommit(d)
+	})
 	if err != nil {
-		http.Error(w, "Error updating deck in storage", http.StatusInternalServerError)
+		writeDeckError(w, err)
+		return
 	}
-	log.Debugf("Deck updated, new card count=%v", len(d.Cards))
 
-	response := DrawResponse{Cards: drawnCards}
+	writeDeck(w, d)
+}
+
+// recommit commits to the new order of a committed deck, the order it
+// committed to no longer matches what is dealt once cards are returned or
+// the deck is reshuffled
+func recommit(d *deck.Deck) error {
+	if d.Commitment == nil {
+		return nil
+	}
+	return d.Commit()
+}
+
+// reshuffles use the algorithm the deck was created with, but with a fresh seed
+func reshuffler(d deck.Deck) deck.Shuffler {
+	s, err := deck.NewShuffler(d.Algorithm, rand.Int63())
+	if err != nil {
+		s, _ = deck.NewShuffler(deck.DefaultAlgorithm, rand.Int63())
+	}
+	return s
+}
+
+func writeDeck(w http.ResponseWriter, d deck.Deck) {
+	response := DeckResponse{
+		DeckID:    d.ID.String(),
+		Shuffled:  d.Shuffled,
+		Remaining: len(d.Cards),
+		Decks:     d.Decks,
+	}
+	if d.Commitment != nil {
+		response.Commitment = d.Commitment.Hash
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", deckETag(d))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writePile(w http.ResponseWriter, d deck.Deck, name string) {
+	pile, _ := d.Pile(name)
+	response := PileResponse{
+		DeckID:    d.ID.String(),
+		Pile:      name,
+		Remaining: len(pile),
+		Cards:     pile,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", deckETag(d))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// lists decks in order of creation, a page at a time
+func (h *Handler) HandleListDecks(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{"endpoint": "handleListDecks"})
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var filter storage.ListFilter
+	if remainingParam := query.Get("remaining_lt"); remainingParam != "" {
+		remaining, err := strconv.Atoi(remainingParam)
+		if err != nil || remaining < 0 {
+			http.Error(w, "Invalid remaining_lt", http.StatusBadRequest)
+			return
+		}
+		filter.RemainingLessThan = &remaining
+	}
+	if shuffledParam := query.Get("shuffled"); shuffledParam != "" {
+		shuffled, err := strconv.ParseBool(shuffledParam)
+		if err != nil {
+			http.Error(w, "Invalid shuffled", http.StatusBadRequest)
+			return
+		}
+		filter.Shuffled = &shuffled
+	}
+	if createdAfterParam := query.Get("created_after"); createdAfterParam != "" {
+		createdAfter, err := time.Parse(time.RFC3339, createdAfterParam)
+		if err != nil {
+			http.Error(w, "Invalid created_after", http.StatusBadRequest)
+			return
+		}
+		filter.CreatedAfter = createdAfter
+	}
+	if limitParam := query.Get("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > storage.MaxListLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+
+	page, err := h.st.List(r.Context(), filter, query.Get("cursor"))
+	if errors.Is(err, storage.ErrInvalidCursor) {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Error listing decks")
+		http.Error(w, "Error listing decks", http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("Listing %d decks", len(page.Decks))
+
+	response := ListDecksResponse{
+		Decks:      make([]DeckSummary, 0, len(page.Decks)),
+		NextCursor: page.NextCursor,
+	}
+	for _, d := range page.Decks {
+		response.Decks = append(response.Decks, DeckSummary{
+			DeckID:    d.ID.String(),
+			Shuffled:  d.Shuffled,
+			Remaining: len(d.Cards),
+			CreatedAt: d.CreatedAt,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// deletes the deck, leaving a tombstone so it's reported as gone for a while
+func (h *Handler) HandleDeleteDeck(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleDeleteDeck",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.st.DeleteDeck(r.Context(), deckID); err != nil {
+		writeDeckError(w, err)
+		return
+	}
+	log.Debug("Deck deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WithActor passes who makes the request to storage, which records it on the
+// events of the request. Only admins, who prove themselves with the token,
+// are recorded, by their X-Actor header or as "admin" without it. Players
+// have no identity the service could check, so their events have no actor
+func WithActor(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || !hasToken(r, token) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		actor := strings.TrimSpace(r.Header.Get("X-Actor"))
+		if actor == "" {
+			actor = "admin"
+		}
+		next.ServeHTTP(w, r.WithContext(storage.WithActor(r.Context(), actor)))
+	})
+}
+
+// fetches the deck history, which deleted decks keep for as long as their tombstone
+func (h *Handler) deckHistory(w http.ResponseWriter, r *http.Request, log *logrus.Entry) (deck.Deck, bool) {
+	deckID, ok := parseDeckID(w, r)
+	if !ok {
+		return deck.Deck{}, false
+	}
+	d, err := h.st.DeckHistory(r.Context(), deckID)
+	if errors.Is(err, storage.ErrDeckNotFound) {
+		http.Error(w, "Deck not found", http.StatusNotFound)
+		return deck.Deck{}, false
+	}
+	if err != nil {
+		log.WithError(err).Error("Error reading deck history")
+		http.Error(w, "Error reading deck history", http.StatusInternalServerError)
+		return deck.Deck{}, false
+	}
+	return d, true
+}
+
+// lists everything that happened to the deck, in order
+func (h *Handler) HandleDeckEvents(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleDeckEvents",
+		"deck_id":  r.PathValue("id"),
+	})
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d, ok := h.deckHistory(w, r, log)
+	if !ok {
+		return
+	}
+	log.Debugf("Listing %d deck events", len(d.Events))
+
+	response := DeckEventsResponse{DeckID: d.ID.String(), Events: h.eventsFor(w, r, d.Events)}
+	if response.Events == nil {
+		response.Events = []deck.Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// rebuilds the deck as it was right after the event
+func (h *Handler) HandleDeckAtEvent(w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"endpoint": "handleDeckAtEvent",
+		"deck_id":  r.PathValue("id"),
+		"index":    r.PathValue("index"),
+	})
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil || index < 0 {
+		http.Error(w, "Invalid event index", http.StatusBadRequest)
+		return
+	}
+	d, ok := h.deckHistory(w, r, log)
+	if !ok {
+		return
+	}
+
+	replayed, err := d.AtEvent(index)
+	switch {
+	case errors.Is(err, deck.ErrEventNotFound):
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	case errors.Is(err, deck.ErrIncompleteHistory):
+		http.Error(w, "Deck history is incomplete", http.StatusConflict)
+		return
+	case err != nil:
+		log.WithError(err).Error("Error replaying deck events")
+		http.Error(w, "Error replaying deck events", http.StatusInternalServerError)
+		return
+	}
+	log.Debug("Replaying deck events")
+
+	response := DeckAtEventResponse{
+		Event: h.eventsFor(w, r, d.Events[index:index+1])[0],
+		Deck:  openDeckResponse(replayed),
+	}
+	response.Deck.Seed = h.seedFor(w, r, replayed)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -136,6 +136,27 @@ func TestHandleDeckCreate(t *testing.T) {
 		{"Can create unshuffled deck of 10 same cards", "POST", "/decks/?cards=AS,AS,AS,AS,AS,AS,AS,AS,AS,AS", http.StatusCreated, false, 10},
 		{"Unknown card codes are ignored", "POST", "/decks/?cards=AS,AS,AS,KH,KD,GG,IDDQD", http.StatusCreated, false, 5},
 		{"Defaults creates deck of 52 cards", "POST", "/decks/", http.StatusCreated, false, 52},
+		{"Can add jokers to full deck", "POST", "/decks/?jokers=2", http.StatusCreated, false, 54},
+		{"Can add jokers to partial deck", "POST", "/decks/?cards=AS,KD&jokers=1", http.StatusCreated, false, 3},
+		{"Joker codes are accepted", "POST", "/decks/?cards=AS,X1,X2", http.StatusCreated, false, 3},
+		{"Invalid number of jokers", "POST", "/decks/?jokers=many", http.StatusBadRequest, false, 0},
+		{"Negative number of jokers", "POST", "/decks/?jokers=-1", http.StatusBadRequest, false, 0},
+		{"Too many jokers", "POST", "/decks/?jokers=5", http.StatusBadRequest, false, 0},
+		{"Can create 6-deck shoe", "POST", "/decks/?decks=6&shuffle=true", http.StatusCreated, true, 312},
+		{"Shoe respects cards and jokers", "POST", "/decks/?decks=2&cards=AS,KD&jokers=1", http.StatusCreated, false, 6},
+		{"Invalid number of decks", "POST", "/decks/?decks=0", http.StatusBadRequest, false, 0},
+		{"Too many decks", "POST", "/decks/?decks=9", http.StatusBadRequest, false, 0},
+		{"Can create piquet deck", "POST", "/decks/?type=piquet", http.StatusCreated, false, 32},
+		{"Can create pinochle deck", "POST", "/decks/?type=pinochle&shuffle=true", http.StatusCreated, true, 48},
+		{"Cards filter respects deck type", "POST", "/decks/?type=euchre&cards=AS,2S,9H", http.StatusCreated, false, 2},
+		{"Unknown deck type", "POST", "/decks/?type=tarot", http.StatusBadRequest, false, 0},
+		{"Can shuffle with crypto/rand", "POST", "/decks/?shuffle=true&algorithm=crypto", http.StatusCreated, true, 52},
+		{"Can shuffle with seeded PCG", "POST", "/decks/?shuffle=true&algorithm=pcg&seed=7", http.StatusCreated, true, 52},
+		{"Unknown shuffle algorithm", "POST", "/decks/?shuffle=true&algorithm=bogo", http.StatusBadRequest, false, 0},
+		{"Can set deck TTL", "POST", "/decks/?ttl=30m", http.StatusCreated, false, 52},
+		{"Invalid TTL", "POST", "/decks/?ttl=soon", http.StatusBadRequest, false, 0},
+		{"Negative TTL", "POST", "/decks/?ttl=-1h", http.StatusBadRequest, false, 0},
+		{"Crypto shuffle can't be seeded", "POST", "/decks/?shuffle=true&algorithm=crypto&seed=7", http.StatusBadRequest, false, 0},
 	}
 
 	for _, tc := range tests {
@@ -239,6 +260,9 @@ func TestHandleOpenDeck(t *testing.T) {
 				if response.Shuffled != expectedShuffled {
 					t.Errorf("shuffled state mismatch: expected %v, got %v", expectedShuffled, response.Shuffled)
 				}
+				if response.Type != deck.DefaultDeckType {
+					t.Errorf("deck type mismatch: expected %s, got %s", deck.DefaultDeckType, response.Type)
+				}
 			}
 		})
 	}
@@ -299,3 +323,753 @@ func TestHandleDrawCards(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleOpenDeckETag(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	mock := deck.NewDeck(fakeUUID, false, []string{"AS", "KD"})
+	if err := h.st.SaveDeck(context.Background(), *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+	etag := `"1"`
+
+	tests := []struct {
+		name           string
+		ifNoneMatch    string
+		expectedStatus int
+	}{
+		{"No conditional header", "", http.StatusOK},
+		{"Current version", etag, http.StatusNotModified},
+		{"Weak current version", "W/" + etag, http.StatusNotModified},
+		{"One of several versions", `"7", ` + etag, http.StatusNotModified},
+		{"Stale version", `"0"`, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/decks/"+fakeUUID.String(), nil)
+			req.SetPathValue("id", fakeUUID.String())
+			if tc.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(h.HandleOpenDeck).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if got := rr.Header().Get("ETag"); got != etag {
+				t.Errorf("expected ETag %s, got %s", etag, got)
+			}
+		})
+	}
+}
+
+func TestHandleDrawCardsIfMatch(t *testing.T) {
+	tests := []struct {
+		name           string
+		ifMatch        string
+		expectedStatus int
+		expectedETag   string
+	}{
+		{"No conditional header", "", http.StatusOK, `"2"`},
+		{"Current version", `"1"`, http.StatusOK, `"2"`},
+		{"Any version", "*", http.StatusOK, `"2"`},
+		{"Stale version", `"0"`, http.StatusPreconditionFailed, ""},
+		{"Weak tags never match", `W/"1"`, http.StatusPreconditionFailed, ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryStorage())
+			mock := deck.NewDeck(fakeUUID, false, []string{"AS", "KD", "QH", "2C"})
+			ctx := context.Background()
+			if err := h.st.SaveDeck(ctx, *mock); err != nil {
+				t.Fatal("Error saving dummy deck in storage")
+			}
+
+			req, _ := http.NewRequest("POST", "/decks/"+fakeUUID.String()+"/draw?count=1", nil)
+			req.SetPathValue("id", fakeUUID.String())
+			if tc.ifMatch != "" {
+				req.Header.Set("If-Match", tc.ifMatch)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(h.HandleDrawCards).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if got := rr.Header().Get("ETag"); got != tc.expectedETag {
+				t.Errorf("expected ETag %q, got %q", tc.expectedETag, got)
+			}
+
+			d, _ := h.st.GetDeck(ctx, fakeUUID)
+			if tc.expectedStatus != http.StatusOK && len(d.Cards) != len(mock.Cards) {
+				t.Errorf("rejected draw still removed cards from the deck")
+			}
+		})
+	}
+}
+
+func TestHandleCreateDeckStrict(t *testing.T) {
+	tests := []struct {
+		name             string
+		path             string
+		expectedStatus   int
+		expectedRejected []RejectedCode
+	}{
+		{"Valid codes", "/decks/?strict=true&cards=AS,KD,X1", http.StatusCreated, nil},
+		{"Unknown codes are ignored when not strict", "/decks/?cards=AS,GG,IDDQD", http.StatusCreated, nil},
+		{
+			"Unknown codes are rejected",
+			"/decks/?strict=true&cards=AS,AS,GG,KH,IDDQD",
+			http.StatusBadRequest,
+			[]RejectedCode{
+				{Position: 2, Code: "GG", Reason: deck.ErrUnknownCode.Error()},
+				{Position: 4, Code: "IDDQD", Reason: deck.ErrUnknownCode.Error()},
+			},
+		},
+		{
+			"Codes outside of deck type are rejected",
+			"/decks/?strict=true&type=piquet&cards=AS,2S",
+			http.StatusBadRequest,
+			[]RejectedCode{
+				{Position: 1, Code: "2S", Reason: deck.ErrNotInDeckType.Error()},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryStorage())
+			req, _ := http.NewRequest("POST", tc.path, nil)
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(h.HandleCreateDeck).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedStatus != http.StatusBadRequest {
+				return
+			}
+
+			var response ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal("Error decoding server response")
+			}
+			if len(response.Rejected) != len(tc.expectedRejected) {
+				t.Fatalf("expected %d rejected codes, got %v", len(tc.expectedRejected), response.Rejected)
+			}
+			for i, want := range tc.expectedRejected {
+				if response.Rejected[i] != want {
+					t.Errorf("At index %d expected %+v, got %+v", i, want, response.Rejected[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHandleCreateDeckSeed(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage(), WithAdminToken("secret"))
+
+	create := func(path string) (int, DeckResponse) {
+		req, _ := http.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.HandleCreateDeck).ServeHTTP(rr, req)
+		var response DeckResponse
+		_ = json.NewDecoder(rr.Body).Decode(&response)
+		return rr.Code, response
+	}
+
+	if code, _ := create("/decks/?shuffle=true&seed=nope"); code != http.StatusBadRequest {
+		t.Errorf("expected status %v for invalid seed, got %v", http.StatusBadRequest, code)
+	}
+
+	_, first := create("/decks/?shuffle=true&seed=1234")
+	_, second := create("/decks/?shuffle=true&seed=1234")
+	if first.Seed == nil || *first.Seed != 1234 {
+		t.Fatalf("expected seed 1234 in response, got %v", first.Seed)
+	}
+
+	ctx := context.Background()
+	d1, _ := h.st.GetDeck(ctx, uuid.MustParse(first.DeckID))
+	d2, _ := h.st.GetDeck(ctx, uuid.MustParse(second.DeckID))
+	for i := range d1.Cards {
+		if d1.Cards[i] != d2.Cards[i] {
+			t.Fatalf("decks created with the same seed differ at position %d", i)
+		}
+	}
+
+	if _, random := create("/decks/?shuffle=true"); random.Seed == nil {
+		t.Errorf("expected generated seed to be returned for shuffled deck")
+	}
+}
+
+func TestSeedIsOnlyReturnedToAdmins(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		wantSeed bool
+	}{
+		{"Admin gets the seed", "secret", "Bearer secret", true},
+		{"Player doesn't get the seed", "secret", "", false},
+		{"Wrong token doesn't get the seed", "secret", "Bearer guess", false},
+		{"Nobody gets the seed without an admin token", "", "Bearer ", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryStorage(), WithAdminToken(tt.token))
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /decks/", h.HandleCreateDeck)
+			mux.HandleFunc("GET /decks/{id}", h.HandleOpenDeck)
+			mux.HandleFunc("GET /decks/{id}/events/{index}", h.HandleDeckAtEvent)
+			// responses differ by the token only when there is one
+			checkVary := func(rr *httptest.ResponseRecorder, step string) {
+				t.Helper()
+				if got := rr.Header().Get("Vary") == "Authorization"; got != (tt.token != "") {
+					t.Errorf("expected Vary: Authorization on %s to be %v, got %q", step, tt.token != "", rr.Header().Get("Vary"))
+				}
+			}
+
+			req, _ := http.NewRequest("POST", "/decks/?shuffle=true&seed=42", nil)
+			req.Header.Set("Authorization", tt.header)
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			var created DeckResponse
+			_ = json.NewDecoder(rr.Body).Decode(&created)
+			if (created.Seed != nil) != tt.wantSeed {
+				t.Errorf("expected seed returned on create to be %v, got %v", tt.wantSeed, created.Seed)
+			}
+			checkVary(rr, "create")
+
+			req, _ = http.NewRequest("GET", "/decks/"+created.DeckID, nil)
+			req.Header.Set("Authorization", tt.header)
+			rr = httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			var opened OpenDeckResponse
+			_ = json.NewDecoder(rr.Body).Decode(&opened)
+			if (opened.Seed != nil) != tt.wantSeed {
+				t.Errorf("expected seed returned on open to be %v, got %v", tt.wantSeed, opened.Seed)
+			}
+			checkVary(rr, "open")
+
+			req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+			rr = httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			if rr.Code != http.StatusNotModified {
+				t.Errorf("expected conditional open to be %d, got %d", http.StatusNotModified, rr.Code)
+			}
+			checkVary(rr, "conditional open")
+
+			req, _ = http.NewRequest("GET", "/decks/"+created.DeckID+"/events/0", nil)
+			req.Header.Set("Authorization", tt.header)
+			rr = httptest.NewRecorder()
+			mux.ServeHTTP(rr, req)
+			var replayed DeckAtEventResponse
+			_ = json.NewDecoder(rr.Body).Decode(&replayed)
+			if (replayed.Deck.Seed != nil) != tt.wantSeed {
+				t.Errorf("expected seed returned on replay to be %v, got %v", tt.wantSeed, replayed.Deck.Seed)
+			}
+			checkVary(rr, "replay")
+		})
+	}
+}
+
+func TestHandleRevealDeck(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	h.uuidGen = func() uuid.UUID { return fakeUUID }
+
+	serve := func(handler http.HandlerFunc, method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.SetPathValue("id", fakeUUID.String())
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(h.HandleCreateDeck, "POST", "/decks/?shuffle=true&cards=AS,KD,QH,2C")
+	var created DeckResponse
+	if err := json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatal("Error decoding server response")
+	}
+	if len(created.Commitment) != 64 {
+		t.Fatalf("expected SHA-256 commitment in response, got %q", created.Commitment)
+	}
+
+	if rr := serve(h.HandleRevealDeck, "GET", "/decks/"+fakeUUID.String()+"/reveal"); rr.Code != http.StatusConflict {
+		t.Errorf("expected deck in play not to be revealed, got status %v", rr.Code)
+	}
+
+	var draw DrawResponse
+	rr = serve(h.HandleDrawCards, "POST", "/decks/"+fakeUUID.String()+"/draw?count=4")
+	if err := json.NewDecoder(rr.Body).Decode(&draw); err != nil {
+		t.Fatal("Error decoding server response")
+	}
+
+	rr = serve(h.HandleRevealDeck, "GET", "/decks/"+fakeUUID.String()+"/reveal")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected exhausted deck to be revealed, got status %v", rr.Code)
+	}
+	var reveal RevealResponse
+	if err := json.NewDecoder(rr.Body).Decode(&reveal); err != nil {
+		t.Fatal("Error decoding server response")
+	}
+	if reveal.Commitment != created.Commitment {
+		t.Errorf("revealed commitment %s differs from the one on creation %s", reveal.Commitment, created.Commitment)
+	}
+	if !deck.VerifyCommitment(created.Commitment, reveal.Salt, reveal.Order) {
+		t.Errorf("revealed salt and order do not verify")
+	}
+	for i, card := range draw.Cards {
+		if reveal.Order[i] != card.Code {
+			t.Errorf("revealed order differs from dealt cards at position %d", i)
+		}
+	}
+
+	// returning and reshuffling changes the order, so the deck commits again
+	for _, change := range []struct {
+		handler http.HandlerFunc
+		path    string
+	}{{h.HandleReturnCards, "/return"}, {h.HandleShuffleDeck, "/shuffle"}} {
+		rr = serve(change.handler, "POST", "/decks/"+fakeUUID.String()+change.path)
+		var changed DeckResponse
+		if err := json.NewDecoder(rr.Body).Decode(&changed); err != nil {
+			t.Fatal("Error decoding server response")
+		}
+		if len(changed.Commitment) != 64 || changed.Commitment == created.Commitment {
+			t.Errorf("expected a new commitment after %s, got %q", change.path, changed.Commitment)
+		}
+		created = changed
+	}
+	serve(h.HandleDrawCards, "POST", "/decks/"+fakeUUID.String()+"/draw?count=4")
+	rr = serve(h.HandleRevealDeck, "GET", "/decks/"+fakeUUID.String()+"/reveal")
+	reveal = RevealResponse{}
+	if err := json.NewDecoder(rr.Body).Decode(&reveal); err != nil {
+		t.Fatal("Error decoding server response")
+	}
+	if reveal.Commitment != created.Commitment || !deck.VerifyCommitment(reveal.Commitment, reveal.Salt, reveal.Order) {
+		t.Errorf("expected the commitment made on the last shuffle to be revealed, got %+v", reveal)
+	}
+	if len(reveal.Previous) != 2 || reveal.Previous[0].Order[0] != draw.Cards[0].Code {
+		t.Errorf("expected the commitments made on creation and return to be revealed, got %+v", reveal.Previous)
+	}
+	for _, c := range reveal.Previous {
+		if !deck.VerifyCommitment(c.Hash, c.Salt, c.Order) {
+			t.Errorf("previous commitment %s does not verify", c.Hash)
+		}
+	}
+}
+
+func TestHandleCloseDeck(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	ctx := context.Background()
+	mock := deck.NewDeck(fakeUUID, true, nil)
+	_ = mock.Commit()
+	if err := h.st.SaveDeck(ctx, *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+
+	serve := func(handler http.HandlerFunc, method, path string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		req.SetPathValue("id", fakeUUID.String())
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve(h.HandleCloseDeck, "POST", "/decks/"+fakeUUID.String()+"/close"); code != http.StatusNoContent {
+		t.Fatalf("expected status %v, got %v", http.StatusNoContent, code)
+	}
+	if code := serve(h.HandleDrawCards, "POST", "/decks/"+fakeUUID.String()+"/draw?count=1"); code != http.StatusConflict {
+		t.Errorf("expected closed deck to refuse draws, got status %v", code)
+	}
+	if code := serve(h.HandleRevealDeck, "GET", "/decks/"+fakeUUID.String()+"/reveal"); code != http.StatusOK {
+		t.Errorf("expected closed deck to be revealed, got status %v", code)
+	}
+}
+
+func TestHandlePiles(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	ctx := context.Background()
+	mock := deck.NewDeck(fakeUUID, false, []string{"AS", "KD", "QH", "2C"})
+	if err := h.st.SaveDeck(ctx, *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+
+	serve := func(handler http.HandlerFunc, method, name, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/decks/"+fakeUUID.String()+"/piles/"+name+query, nil)
+		req.SetPathValue("id", fakeUUID.String())
+		req.SetPathValue("name", name)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		pile           string
+		query          string
+		expectedStatus int
+		expectedDeck   int
+		expectedPile   int
+	}{
+		{"Method Not Allowed", h.HandleAddToPile, "GET", "hand", "/add?cards=AS", http.StatusMethodNotAllowed, 4, 0},
+		{"Invalid pile name", h.HandleAddToPile, "POST", "bad name!", "/add?cards=AS", http.StatusBadRequest, 4, 0},
+		{"Missing cards", h.HandleAddToPile, "POST", "hand", "/add", http.StatusBadRequest, 4, 0},
+		{"Unknown pile", h.HandleOpenPile, "GET", "hand", "", http.StatusNotFound, 4, 0},
+		{"Card not in deck", h.HandleAddToPile, "POST", "hand", "/add?cards=AS,3S", http.StatusConflict, 4, 0},
+		{"Add cards", h.HandleAddToPile, "POST", "hand", "/add?cards=AS,QH", http.StatusOK, 2, 2},
+		{"Card already in pile", h.HandleAddToPile, "POST", "hand", "/add?cards=AS", http.StatusConflict, 2, 2},
+		{"Open pile", h.HandleOpenPile, "GET", "hand", "", http.StatusOK, 2, 2},
+		{"Draw too many from pile", h.HandleDrawFromPile, "POST", "hand", "/draw?count=3", http.StatusBadRequest, 2, 2},
+		{"Draw from unknown pile", h.HandleDrawFromPile, "POST", "discard", "/draw?count=1", http.StatusNotFound, 2, 2},
+		{"Draw from pile", h.HandleDrawFromPile, "POST", "hand", "/draw?count=1", http.StatusOK, 2, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(tc.handler, tc.method, tc.pile, tc.query)
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+
+			d, _ := h.st.GetDeck(ctx, fakeUUID)
+			pile, _ := d.Pile("hand")
+			if len(d.Cards) != tc.expectedDeck || len(pile) != tc.expectedPile {
+				t.Errorf("expected %d cards in deck and %d in pile, got %d and %d", tc.expectedDeck, tc.expectedPile, len(d.Cards), len(pile))
+			}
+		})
+	}
+}
+
+func TestHandleReturnAndShuffle(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	ctx := context.Background()
+	mock := deck.NewDeck(fakeUUID, false, nil)
+	mock.Draw(5)
+	if err := h.st.SaveDeck(ctx, *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+	drawn := mock.Drawn
+
+	tests := []struct {
+		name              string
+		handler           http.HandlerFunc
+		query             string
+		expectedStatus    int
+		expectedRemaining int
+	}{
+		{"Return card never drawn", h.HandleReturnCards, "/return?cards=KH", http.StatusConflict, 47},
+		{"Return specific cards", h.HandleReturnCards, "/return?cards=" + drawn[0].Code + "," + drawn[1].Code, http.StatusOK, 49},
+		{"Return card twice", h.HandleReturnCards, "/return?cards=" + drawn[0].Code, http.StatusConflict, 49},
+		{"Shuffle remaining only", h.HandleShuffleDeck, "/shuffle?remaining_only=true", http.StatusOK, 49},
+		{"Shuffle everything", h.HandleShuffleDeck, "/shuffle", http.StatusOK, 52},
+		{"Nothing left to return", h.HandleReturnCards, "/return", http.StatusOK, 52},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/decks/"+fakeUUID.String()+tc.query, nil)
+			req.SetPathValue("id", fakeUUID.String())
+			rr := httptest.NewRecorder()
+			tc.handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			d, _ := h.st.GetDeck(ctx, fakeUUID)
+			if len(d.Cards) != tc.expectedRemaining {
+				t.Errorf("expected %d cards in deck, got %d", tc.expectedRemaining, len(d.Cards))
+			}
+			if len(d.Cards)+len(d.Drawn) != 52 {
+				t.Errorf("cards got lost: %d in deck and %d drawn", len(d.Cards), len(d.Drawn))
+			}
+		})
+	}
+
+	d, _ := h.st.GetDeck(ctx, fakeUUID)
+	if !d.Shuffled {
+		t.Errorf("expected deck to be marked as shuffled")
+	}
+}
+
+func TestHandleDrawCardsModes(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedCodes  []string
+	}{
+		{"Draw from top by default", "count=2", http.StatusOK, []string{"AS", "KD"}},
+		{"Draw from top", "count=1&from=top", http.StatusOK, []string{"AS"}},
+		{"Draw from bottom", "count=2&from=bottom", http.StatusOK, []string{"2C", "QH"}},
+		{"Draw from random position", "count=4&from=random", http.StatusOK, nil},
+		{"Invalid draw position", "count=1&from=middle", http.StatusBadRequest, nil},
+		{"Draw specific cards", "cards=QH,AS", http.StatusOK, []string{"QH", "AS"}},
+		{"Draw specific cards not in deck", "cards=QH,3S", http.StatusConflict, nil},
+		{"Draw same card twice", "cards=QH,QH", http.StatusConflict, nil},
+		{"Specific cards can't be combined with from", "cards=QH&from=bottom", http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryStorage())
+			ctx := context.Background()
+			mock := deck.NewDeck(fakeUUID, false, []string{"AS", "KD", "QH", "2C"})
+			if err := h.st.SaveDeck(ctx, *mock); err != nil {
+				t.Fatal("Error saving dummy deck in storage")
+			}
+
+			req, _ := http.NewRequest("POST", "/decks/"+fakeUUID.String()+"/draw?"+tc.query, nil)
+			req.SetPathValue("id", fakeUUID.String())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(h.HandleDrawCards).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			d, _ := h.st.GetDeck(ctx, fakeUUID)
+			if tc.expectedStatus != http.StatusOK {
+				if len(d.Cards) != 4 {
+					t.Errorf("failed draw removed cards from the deck")
+				}
+				return
+			}
+
+			var response DrawResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatal("Error decoding server response")
+			}
+			for i, code := range tc.expectedCodes {
+				if response.Cards[i].Code != code {
+					t.Errorf("At position %d expected %s, got %s", i, code, response.Cards[i].Code)
+				}
+			}
+			if len(d.Cards)+len(response.Cards) != 4 {
+				t.Errorf("expected %d cards left in deck, got %d", 4-len(response.Cards), len(d.Cards))
+			}
+		})
+	}
+}
+
+// committed decks only deal in the order they committed to
+func TestHandleDrawCardsFromCommittedDeck(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+	}{
+		{"Draw from top", "count=1", http.StatusOK},
+		{"Draw from bottom", "count=1&from=bottom", http.StatusOK},
+		{"Draw from random position", "count=1&from=random", http.StatusConflict},
+		{"Draw specific cards", "cards=QH", http.StatusConflict},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := NewHandler(storage.NewInMemoryStorage())
+			ctx := context.Background()
+			mock := deck.NewDeck(fakeUUID, false, []string{"AS", "KD", "QH", "2C"})
+			if err := mock.Commit(); err != nil {
+				t.Fatalf("Commit failed: %s", err)
+			}
+			if err := h.st.SaveDeck(ctx, *mock); err != nil {
+				t.Fatal("Error saving dummy deck in storage")
+			}
+
+			req, _ := http.NewRequest("POST", "/decks/"+fakeUUID.String()+"/draw?"+tc.query, nil)
+			req.SetPathValue("id", fakeUUID.String())
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(h.HandleDrawCards).ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if d, _ := h.st.GetDeck(ctx, fakeUUID); tc.expectedStatus != http.StatusOK && len(d.Cards) != 4 {
+				t.Errorf("rejected draw removed cards from the deck")
+			}
+		})
+	}
+}
+
+func TestHandleDeleteDeck(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	mock := deck.NewDeck(fakeUUID, false, nil)
+	if err := h.st.SaveDeck(context.Background(), *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		deckID         string
+		expectedStatus int
+	}{
+		{"Method Not Allowed", h.HandleDeleteDeck, "POST", fakeUUID.String(), http.StatusMethodNotAllowed},
+		{"Invalid Deck ID", h.HandleDeleteDeck, "DELETE", "invalid-uuid", http.StatusBadRequest},
+		{"Deck Not Found", h.HandleDeleteDeck, "DELETE", uuid.New().String(), http.StatusNotFound},
+		{"Successful Delete", h.HandleDeleteDeck, "DELETE", fakeUUID.String(), http.StatusNoContent},
+		{"Delete Twice", h.HandleDeleteDeck, "DELETE", fakeUUID.String(), http.StatusGone},
+		{"Open Deleted Deck", h.HandleOpenDeck, "GET", fakeUUID.String(), http.StatusGone},
+		{"Draw From Deleted Deck", h.HandleDrawCards, "POST", fakeUUID.String(), http.StatusGone},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, "/decks/"+tc.deckID+"?count=1", nil)
+			req.SetPathValue("id", tc.deckID)
+			rr := httptest.NewRecorder()
+			tc.handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestHandleListDecks(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage())
+	for i := 0; i < 3; i++ {
+		if err := h.st.SaveDeck(context.Background(), *deck.NewDeck(uuid.New(), i == 0, nil)); err != nil {
+			t.Fatal("Error saving dummy deck in storage")
+		}
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedDecks  int
+	}{
+		{"All Decks", "", http.StatusOK, 3},
+		{"Shuffled", "shuffled=true", http.StatusOK, 1},
+		{"Remaining Less Than", "remaining_lt=52", http.StatusOK, 0},
+		{"Created After", "created_after=2000-01-01T00:00:00Z", http.StatusOK, 3},
+		{"Limit", "limit=2", http.StatusOK, 2},
+		{"Invalid Limit", "limit=0", http.StatusBadRequest, 0},
+		{"Invalid Shuffled", "shuffled=maybe", http.StatusBadRequest, 0},
+		{"Invalid Created After", "created_after=yesterday", http.StatusBadRequest, 0},
+		{"Invalid Cursor", "cursor=garbage", http.StatusBadRequest, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/decks/?"+tc.query, nil)
+			rr := httptest.NewRecorder()
+			h.HandleListDecks(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var response ListDecksResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Error decoding response: %s", err)
+			}
+			if len(response.Decks) != tc.expectedDecks {
+				t.Errorf("expected %d decks, got %d", tc.expectedDecks, len(response.Decks))
+			}
+			if (response.NextCursor != "") != (tc.query == "limit=2") {
+				t.Errorf("unexpected next_cursor %q", response.NextCursor)
+			}
+		})
+	}
+}
+
+func TestHandleDeckEvents(t *testing.T) {
+	h := NewHandler(storage.NewInMemoryStorage(), WithAdminToken("secret"))
+	mock := deck.NewDeck(fakeUUID, false, nil)
+	if err := h.st.SaveDeck(context.Background(), *mock); err != nil {
+		t.Fatal("Error saving dummy deck in storage")
+	}
+
+	// every request goes through the middleware, as it does in the server
+	serve := func(handler http.HandlerFunc, method, path, index, auth string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.SetPathValue("id", fakeUUID.String())
+		req.SetPathValue("index", index)
+		req.Header.Set("X-Actor", "dealer")
+		req.Header.Set("Authorization", auth)
+		rr := httptest.NewRecorder()
+		WithActor("secret", handler).ServeHTTP(rr, req)
+		return rr
+	}
+	listEvents := func(auth string) []deck.Event {
+		t.Helper()
+		rr := serve(h.HandleDeckEvents, "GET", "/decks/"+fakeUUID.String()+"/events", "", auth)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %v, got %v", http.StatusOK, rr.Code)
+		}
+		var events DeckEventsResponse
+		if err := json.NewDecoder(rr.Body).Decode(&events); err != nil {
+			t.Fatalf("Error decoding response: %s", err)
+		}
+		return events.Events
+	}
+	serve(h.HandleDrawCards, "POST", "/decks/"+fakeUUID.String()+"/draw?count=2", "", "Bearer secret")
+	// players can't claim to be someone else
+	serve(h.HandleDeleteDeck, "DELETE", "/decks/"+fakeUUID.String(), "", "")
+
+	// deleted decks keep their history
+	events := listEvents("Bearer secret")
+	expected := []deck.EventType{deck.EventCreated, deck.EventDrawn, deck.EventDeleted}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		if e.Type != expected[i] {
+			t.Errorf("expected event %d to be %s, got %s", i, expected[i], e.Type)
+		}
+	}
+	if actor := events[1].Actor; actor != "dealer" {
+		t.Errorf("expected draw by dealer, got %q", actor)
+	}
+	if actor := events[2].Actor; actor != "" {
+		t.Errorf("expected no actor on the deletion by a player, got %q", actor)
+	}
+	for i, e := range listEvents("") {
+		if e.Actor != "" {
+			t.Errorf("expected actor of event %d to be hidden from players, got %q", i, e.Actor)
+		}
+	}
+
+	tests := []struct {
+		name              string
+		index             string
+		expectedStatus    int
+		expectedRemaining int
+	}{
+		{"Created", "0", http.StatusOK, 52},
+		{"Drawn", "1", http.StatusOK, 50},
+		{"Event Not Found", "3", http.StatusNotFound, 0},
+		{"Invalid Index", "first", http.StatusBadRequest, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(h.HandleDeckAtEvent, "GET", "/decks/"+fakeUUID.String()+"/events/"+tc.index, tc.index, "")
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("expected status %v, got %v", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var response DeckAtEventResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Fatalf("Error decoding response: %s", err)
+			}
+			if response.Deck.Remaining != tc.expectedRemaining {
+				t.Errorf("expected %d cards remaining, got %d", tc.expectedRemaining, response.Deck.Remaining)
+			}
+			if response.Event.Actor != "" {
+				t.Errorf("expected actor to be hidden from players, got %q", response.Event.Actor)
+			}
+		})
+	}
+}
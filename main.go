@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 
 	"deck-of-cards/handlers"
@@ -17,6 +26,144 @@ func init() {
 	logrus.SetLevel(logrus.InfoLevel)
 }
 
+// reads a duration like "30m" from the environment, exits on malformed values
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Fatalf("Invalid %s=%s: %s", name, value, err)
+	}
+	return d
+}
+
+// reads a positive integer from the environment, exits on malformed values
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		logrus.Fatalf("Invalid %s=%s", name, value)
+	}
+	return n
+}
+
+// janitorStorage evicts expired decks in the background
+type janitorStorage interface {
+	storage.DeckStorage
+	RunJanitor(ctx context.Context, interval time.Duration)
+}
+
+// snapshotter is storage which can write all its decks out at once, so the
+// next start doesn't have to replay its log
+type snapshotter interface {
+	Snapshot() error
+}
+
+// closeStorage takes a last snapshot and closes the storage, once nothing
+// uses it anymore
+func closeStorage(st janitorStorage) {
+	if s, ok := st.(snapshotter); ok {
+		if err := s.Snapshot(); err != nil {
+			logrus.WithError(err).Error("Failure in taking the last storage snapshot")
+		}
+	}
+	if c, ok := st.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logrus.WithError(err).Error("Failure in closing storage")
+		}
+	}
+}
+
+// picks the storage from STORAGE, which is either "memory" (the default),
+// "memory:/path/to/dir" for durable memory storage, "file:/path/to/dir",
+// "sqlite:/path/to/decks.db" or a redis:// URL
+func storageFromEnv(ctx context.Context, opts ...storage.Option) janitorStorage {
+	value := os.Getenv("STORAGE")
+	kind, arg, _ := strings.Cut(value, ":")
+	switch kind {
+	case "", "memory":
+		if arg == "" {
+			return storage.NewInMemoryStorage(opts...)
+		}
+		st, err := storage.NewDurableInMemoryStorage(arg, opts...)
+		if err != nil {
+			logrus.Fatalf("Invalid STORAGE=%s: %s", value, err)
+		}
+		go st.RunSnapshots(ctx, durationFromEnv("SNAPSHOT_INTERVAL", 5*time.Minute))
+		return st
+	case "file":
+		if arg == "" {
+			logrus.Fatal("STORAGE=file requires a directory, like STORAGE=file:/var/lib/decks")
+		}
+		st, err := storage.NewFileStorage(arg, opts...)
+		if err != nil {
+			logrus.Fatalf("Invalid STORAGE=%s: %s", value, err)
+		}
+		return st
+	case "sqlite":
+		if arg == "" {
+			logrus.Fatal("STORAGE=sqlite requires a database file, like STORAGE=sqlite:/var/lib/decks.db")
+		}
+		st, err := storage.NewSQLiteStorage(arg, opts...)
+		if err != nil {
+			logrus.Fatalf("Invalid STORAGE=%s: %s", value, err)
+		}
+		return st
+	case "redis", "rediss":
+		redisOpts, err := redis.ParseURL(value)
+		if err != nil {
+			logrus.Fatalf("Invalid STORAGE=%s: %s", value, err)
+		}
+		return storage.NewRedisStorage(redis.NewClient(redisOpts), opts...)
+	}
+	logrus.Fatalf("Unknown STORAGE=%s", value)
+	return nil
+}
+
+// picks the storage decorators from STORAGE_DECORATORS, a comma separated
+// list of "log", "metrics" and "cache", the first one being the outermost.
+// The metrics are only returned when "metrics" is listed. The options are
+// those of the storage, the cache expires decks along with it
+func decoratorsFromEnv(opts ...storage.Option) ([]storage.Decorator, *storage.Metrics) {
+	value := os.Getenv("STORAGE_DECORATORS")
+	if value == "" {
+		return nil, nil
+	}
+	var (
+		decorators []storage.Decorator
+		metrics    *storage.Metrics
+	)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			logrus.Fatalf("Storage decorator %q is listed twice in STORAGE_DECORATORS=%s", name, value)
+		}
+		seen[name] = true
+		switch name {
+		case "log":
+			decorators = append(decorators, storage.Logging(logrus.DebugLevel))
+		case "metrics":
+			metrics = storage.NewMetrics()
+			decorators = append(decorators, storage.Instrument(metrics))
+		case "cache":
+			decorators = append(decorators, storage.Cache(
+				intFromEnv("CACHE_SIZE", 1024),
+				durationFromEnv("CACHE_TTL", time.Minute),
+				opts...,
+			))
+		default:
+			logrus.Fatalf("Unknown storage decorator %q in STORAGE_DECORATORS=%s", name, value)
+		}
+	}
+	return decorators, metrics
+}
+
 func main() {
 	debug := os.Getenv("DEBUG")
 	if debug == "1" {
@@ -24,8 +171,18 @@ func main() {
 		logrus.Debug("Logging debug output, run without DEBUG=1 to disable")
 	}
 
-	st := storage.NewInMemoryStorage()
-	h := handlers.NewHandler(st)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	opts := []storage.Option{
+		storage.WithTTL(durationFromEnv("DECK_TTL", 0)),
+		storage.WithTombstoneTTL(durationFromEnv("TOMBSTONE_TTL", storage.DefaultTombstoneTTL)),
+	}
+	st := storageFromEnv(ctx, opts...)
+	go st.RunJanitor(ctx, durationFromEnv("JANITOR_INTERVAL", time.Minute))
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	decorators, metrics := decoratorsFromEnv(opts...)
+	h := handlers.NewHandler(storage.Chain(st, decorators...), handlers.WithAdminToken(adminToken))
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -34,10 +191,52 @@ func main() {
 
 	http.HandleFunc("POST /decks/", h.HandleCreateDeck)
 	http.HandleFunc("GET /decks/{id}", h.HandleOpenDeck)
+	http.HandleFunc("DELETE /decks/{id}", h.HandleDeleteDeck)
 	http.HandleFunc("POST /decks/{id}/draw", h.HandleDrawCards)
+	http.HandleFunc("POST /decks/{id}/return", h.HandleReturnCards)
+	http.HandleFunc("POST /decks/{id}/shuffle", h.HandleShuffleDeck)
+	http.HandleFunc("POST /decks/{id}/close", h.HandleCloseDeck)
+	http.HandleFunc("GET /decks/{id}/reveal", h.HandleRevealDeck)
+	http.HandleFunc("GET /decks/{id}/events", h.HandleDeckEvents)
+	http.HandleFunc("GET /decks/{id}/events/{index}", h.HandleDeckAtEvent)
+	http.HandleFunc("POST /decks/{id}/piles/{name}/add", h.HandleAddToPile)
+	http.HandleFunc("GET /decks/{id}/piles/{name}", h.HandleOpenPile)
+	http.HandleFunc("POST /decks/{id}/piles/{name}/draw", h.HandleDrawFromPile)
+	// deck IDs are all it takes to play or delete a deck, so only admins may list them
+	if adminToken != "" {
+		http.Handle("GET /decks/{$}", handlers.RequireToken(adminToken, http.HandlerFunc(h.HandleListDecks)))
+		http.Handle("GET /admin/export", handlers.RequireToken(adminToken, http.HandlerFunc(h.HandleExport)))
+		http.Handle("POST /admin/import", handlers.RequireToken(adminToken, http.HandlerFunc(h.HandleImport)))
+		if metrics != nil {
+			http.Handle("GET /admin/metrics", handlers.RequireToken(adminToken, handlers.MetricsHandler(metrics)))
+		}
+	} else if metrics != nil {
+		logrus.Warn("Storage metrics are counted but not served, they are only served to admins with ADMIN_TOKEN set")
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: handlers.WithActor(adminToken, http.DefaultServeMux),
+	}
+	// ListenAndServe returns as soon as Shutdown starts, main waits for the
+	// requests in flight before closing the storage they use
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		logrus.Info("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logrus.WithError(err).Error("Failure in shutting down card deck server")
+		}
+	}()
 
 	logrus.Infof("Listening on port %s", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil); err != nil {
-		logrus.Error("Failure in running card deck server")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.WithError(err).Error("Failure in running card deck server")
+		stop()
 	}
+	<-shutdown
+	closeStorage(st)
 }
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+)
+
+type cacheEntry struct {
+	deck     deck.Deck
+	cachedAt time.Time
+}
+
+// cachingStorage keeps the most recently read decks in front of next
+type cachingStorage struct {
+	next DeckStorage
+	size int
+	ttl  time.Duration
+	// settings are those of the storage underneath, so decks it would
+	// evict as expired are never served from the cache
+	settings Settings
+
+	mu sync.Mutex
+	// lru has the most recently used entries at the front
+	lru     *list.List
+	entries map[uuid.UUID]*list.Element
+	// gen is bumped by every write, reads started before it don't fill the
+	// cache, so they can't bring back a deck the write replaced
+	gen uint64
+}
+
+// Cache serves GetDeck from an LRU cache of up to size decks, each kept for
+// at most ttl. Writes through the decorated storage invalidate their deck,
+// writes by other processes sharing the backend show up once ttl runs out.
+//
+// Reads served from the cache don't reach the backend, so they don't count
+// as access to the deck for its TTL. The options must be the ones the
+// storage underneath was made with, cached decks expire along with the ones
+// it evicts
+func Cache(size int, ttl time.Duration, opts ...Option) Decorator {
+	return func(next DeckStorage) DeckStorage {
+		return &cachingStorage{
+			next:     next,
+			size:     size,
+			ttl:      ttl,
+			settings: ApplyOptions(opts...),
+			lru:      list.New(),
+			entries:  make(map[uuid.UUID]*list.Element),
+		}
+	}
+}
+
+func (s *cachingStorage) get(id uuid.UUID) (deck.Deck, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, found := s.entries[id]
+	if !found {
+		return deck.Deck{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if s.settings.Now().Sub(entry.cachedAt) >= s.ttl || s.settings.Expired(entry.deck) {
+		s.lru.Remove(el)
+		delete(s.entries, id)
+		return deck.Deck{}, false
+	}
+	s.lru.MoveToFront(el)
+	return entry.deck.Clone(), true
+}
+
+// put caches the deck unless a write happened since gen was read
+func (s *cachingStorage) put(d deck.Deck, gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen || s.size < 1 {
+		return
+	}
+	entry := &cacheEntry{deck: d.Clone(), cachedAt: s.settings.Now()}
+	if el, found := s.entries[d.ID]; found {
+		el.Value = entry
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[d.ID] = s.lru.PushFront(entry)
+	if s.lru.Len() > s.size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*cacheEntry).deck.ID)
+	}
+}
+
+func (s *cachingStorage) generation() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gen
+}
+
+// invalidate drops the deck after a write to it, whether it succeeded or not
+func (s *cachingStorage) invalidate(id uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gen++
+	if el, found := s.entries[id]; found {
+		s.lru.Remove(el)
+		delete(s.entries, id)
+	}
+}
+
+func (s *cachingStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	defer s.invalidate(d.ID)
+	return s.next.SaveDeck(ctx, d)
+}
+
+func (s *cachingStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	if d, found := s.get(id); found {
+		return d, true
+	}
+	gen := s.generation()
+	d, found := s.next.GetDeck(ctx, id)
+	if found {
+		s.put(d, gen)
+	}
+	return d, found
+}
+
+func (s *cachingStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	defer s.invalidate(id)
+	return s.next.DeleteDeck(ctx, id)
+}
+
+func (s *cachingStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	return s.next.DeckDeleted(ctx, id)
+}
+
+func (s *cachingStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	defer s.invalidate(d.ID)
+	return s.next.UpdateDeck(ctx, d)
+}
+
+func (s *cachingStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	defer s.invalidate(id)
+	return s.next.MutateDeck(ctx, id, fn)
+}
+
+func (s *cachingStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	return s.next.List(ctx, filter, cursor)
+}
+
+func (s *cachingStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	return s.next.DeckHistory(ctx, id)
+}
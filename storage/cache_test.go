@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+)
+
+// countingStorage counts the reads reaching the backend
+type countingStorage struct {
+	DeckStorage
+	reads int
+}
+
+func (s *countingStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	s.reads++
+	return s.DeckStorage.GetDeck(ctx, id)
+}
+
+func newTestCache(size int, ttl time.Duration) (*cachingStorage, *countingStorage, *time.Time) {
+	backend := &countingStorage{DeckStorage: NewInMemoryStorage()}
+	now := time.Now()
+	cache := Cache(size, ttl, WithClock(func() time.Time { return now }))(backend).(*cachingStorage)
+	return cache, backend, &now
+}
+
+func saveDecks(t *testing.T, s DeckStorage, n int) []uuid.UUID {
+	t.Helper()
+	ids := make([]uuid.UUID, n)
+	for i := range ids {
+		d := deck.NewDeck(uuid.New(), false, nil)
+		if err := s.SaveDeck(context.Background(), *d); err != nil {
+			t.Fatalf("SaveDeck failed: %s", err)
+		}
+		ids[i] = d.ID
+	}
+	return ids
+}
+
+func TestCacheServesRepeatedReads(t *testing.T) {
+	cache, backend, now := newTestCache(2, time.Minute)
+	ctx := context.Background()
+	ids := saveDecks(t, cache, 1)
+
+	cache.GetDeck(ctx, ids[0])
+	cache.GetDeck(ctx, ids[0])
+	if backend.reads != 1 {
+		t.Errorf("Expected a single read from the backend, got %d", backend.reads)
+	}
+
+	*now = now.Add(time.Minute)
+	cache.GetDeck(ctx, ids[0])
+	if backend.reads != 2 {
+		t.Errorf("Expected the deck to be read again after the cache TTL, got %d reads", backend.reads)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, backend, _ := newTestCache(2, time.Minute)
+	ctx := context.Background()
+	ids := saveDecks(t, cache, 3)
+
+	cache.GetDeck(ctx, ids[0])
+	cache.GetDeck(ctx, ids[1])
+	cache.GetDeck(ctx, ids[0])
+	// the third deck pushes out the second, which was used longest ago
+	cache.GetDeck(ctx, ids[2])
+
+	backend.reads = 0
+	cache.GetDeck(ctx, ids[0])
+	cache.GetDeck(ctx, ids[2])
+	if backend.reads != 0 {
+		t.Errorf("Expected recently used decks to be cached, got %d reads", backend.reads)
+	}
+	cache.GetDeck(ctx, ids[1])
+	if backend.reads != 1 {
+		t.Errorf("Expected least recently used deck to be evicted, got %d reads", backend.reads)
+	}
+}
+
+func TestCacheDropsDecksOnWrite(t *testing.T) {
+	cache, _, _ := newTestCache(2, time.Minute)
+	ctx := context.Background()
+	ids := saveDecks(t, cache, 1)
+
+	cache.GetDeck(ctx, ids[0])
+	if _, err := cache.MutateDeck(ctx, ids[0], func(d *deck.Deck) error {
+		d.Draw(5)
+		return nil
+	}); err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	if d, _ := cache.GetDeck(ctx, ids[0]); len(d.Cards) != 47 {
+		t.Errorf("Expected the mutated deck to be read, got %d cards", len(d.Cards))
+	}
+
+	if err := cache.DeleteDeck(ctx, ids[0]); err != nil {
+		t.Fatalf("DeleteDeck failed: %s", err)
+	}
+	if _, found := cache.GetDeck(ctx, ids[0]); found {
+		t.Errorf("Expected deleted deck to be dropped from the cache")
+	}
+}
+
+func TestCacheSkipsReadsRacingWrites(t *testing.T) {
+	cache, backend, _ := newTestCache(2, time.Minute)
+	ctx := context.Background()
+	ids := saveDecks(t, cache, 1)
+
+	// a read which started before a write must not cache what it read
+	gen := cache.generation()
+	stale, _ := backend.GetDeck(ctx, ids[0])
+	cache.invalidate(ids[0])
+	cache.put(stale, gen)
+
+	backend.reads = 0
+	cache.GetDeck(ctx, ids[0])
+	if backend.reads != 1 {
+		t.Errorf("Expected the deck read during the write not to be cached")
+	}
+}
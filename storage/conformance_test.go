@@ -0,0 +1,80 @@
+package storage_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/storage"
+	"deck-of-cards/storage/storagetest"
+)
+
+func TestInMemoryStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		return storage.NewInMemoryStorage(opts...)
+	})
+}
+
+func TestDurableInMemoryStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		s, err := storage.NewDurableInMemoryStorage(t.TempDir(), opts...)
+		if err != nil {
+			t.Fatalf("NewDurableInMemoryStorage failed: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestFileStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		s, err := storage.NewFileStorage(t.TempDir(), opts...)
+		if err != nil {
+			t.Fatalf("NewFileStorage failed: %s", err)
+		}
+		return s
+	})
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		s, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "decks.db"), opts...)
+		if err != nil {
+			t.Fatalf("NewSQLiteStorage failed: %s", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestRedisStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { client.Close() })
+		return storage.NewRedisStorage(client, opts...)
+	})
+}
+
+// decoratedStorage lets decorated storage run the conformance tests, which
+// evict expired decks from the storage underneath, like the janitor does.
+// The cache outlives the tests, so only expiry keeps it from serving evicted decks
+type decoratedStorage struct {
+	storage.DeckStorage
+	base storagetest.Storage
+}
+
+func (s decoratedStorage) EvictExpired() int {
+	return s.base.EvictExpired()
+}
+
+func TestDecoratedStorage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		base := storage.NewInMemoryStorage(opts...)
+		st := storage.Chain(base, storage.Logging(logrus.DebugLevel), storage.Instrument(storage.NewMetrics()), storage.Cache(16, 24*time.Hour, opts...))
+		return decoratedStorage{DeckStorage: st, base: base}
+	})
+}
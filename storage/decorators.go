@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/deck"
+)
+
+// Decorator wraps storage to add behaviour around its methods
+type Decorator func(DeckStorage) DeckStorage
+
+// Chain wraps st in the decorators, the first one being the outermost, so
+// Chain(st, Logging(logrus.DebugLevel), Cache(100, time.Minute)) logs every
+// call, including the ones served from the cache
+func Chain(st DeckStorage, decorators ...Decorator) DeckStorage {
+	for i := len(decorators) - 1; i >= 0; i-- {
+		st = decorators[i](st)
+	}
+	return st
+}
+
+// observeFunc is called after every call with the deck ID, which is
+// uuid.Nil for List, how long the call took and the error it returned
+type observeFunc func(method string, id uuid.UUID, took time.Duration, err error)
+
+// observedStorage calls observe after every call to next
+type observedStorage struct {
+	next    DeckStorage
+	observe observeFunc
+}
+
+func observe(fn observeFunc) Decorator {
+	return func(next DeckStorage) DeckStorage {
+		return &observedStorage{next: next, observe: fn}
+	}
+}
+
+func (s *observedStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	start := time.Now()
+	err := s.next.SaveDeck(ctx, d)
+	s.observe("SaveDeck", d.ID, time.Since(start), err)
+	return err
+}
+
+func (s *observedStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	start := time.Now()
+	d, found := s.next.GetDeck(ctx, id)
+	s.observe("GetDeck", id, time.Since(start), nil)
+	return d, found
+}
+
+func (s *observedStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	start := time.Now()
+	err := s.next.DeleteDeck(ctx, id)
+	s.observe("DeleteDeck", id, time.Since(start), err)
+	return err
+}
+
+func (s *observedStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	start := time.Now()
+	deleted := s.next.DeckDeleted(ctx, id)
+	s.observe("DeckDeleted", id, time.Since(start), nil)
+	return deleted
+}
+
+func (s *observedStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	start := time.Now()
+	err := s.next.UpdateDeck(ctx, d)
+	s.observe("UpdateDeck", d.ID, time.Since(start), err)
+	return err
+}
+
+func (s *observedStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	start := time.Now()
+	d, err := s.next.MutateDeck(ctx, id, fn)
+	s.observe("MutateDeck", id, time.Since(start), err)
+	return d, err
+}
+
+func (s *observedStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	start := time.Now()
+	page, err := s.next.List(ctx, filter, cursor)
+	s.observe("List", uuid.Nil, time.Since(start), err)
+	return page, err
+}
+
+func (s *observedStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	start := time.Now()
+	d, err := s.next.DeckHistory(ctx, id)
+	s.observe("DeckHistory", id, time.Since(start), err)
+	return d, err
+}
+
+// Logging logs every call with its deck ID, duration and error at the level.
+// Failures other than missing decks and version conflicts are logged as errors
+func Logging(level logrus.Level) Decorator {
+	return observe(func(method string, id uuid.UUID, took time.Duration, err error) {
+		log := logrus.WithFields(logrus.Fields{
+			"method":   method,
+			"duration": took,
+		})
+		if id != uuid.Nil {
+			log = log.WithField("deck_id", id)
+		}
+		var conflict *ConflictError
+		switch {
+		case err == nil:
+			log.Logf(level, "Storage call")
+		case errors.Is(err, ErrDeckNotFound) || errors.As(err, &conflict):
+			log.WithError(err).Logf(level, "Storage call")
+		default:
+			log.WithError(err).Error("Storage call failed")
+		}
+	})
+}
+
+// MethodStats are the calls to a single storage method
+type MethodStats struct {
+	Calls  int64         `json:"calls"`
+	Errors int64         `json:"errors"`
+	Total  time.Duration `json:"total_ns"`
+	Max    time.Duration `json:"max_ns"`
+}
+
+// Metrics counts calls, errors and latency of every storage method
+type Metrics struct {
+	mu      sync.Mutex
+	methods map[string]*MethodStats
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{methods: make(map[string]*MethodStats)}
+}
+
+func (m *Metrics) record(method string, id uuid.UUID, took time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, found := m.methods[method]
+	if !found {
+		stats = &MethodStats{}
+		m.methods[method] = stats
+	}
+	stats.Calls++
+	if err != nil {
+		stats.Errors++
+	}
+	stats.Total += took
+	stats.Max = max(stats.Max, took)
+}
+
+// Stats returns a copy of the stats of every method called so far
+func (m *Metrics) Stats() map[string]MethodStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := make(map[string]MethodStats, len(m.methods))
+	for method, s := range m.methods {
+		stats[method] = *s
+	}
+	return stats
+}
+
+// Instrument records every call in m. Missing decks and version conflicts
+// count as errors too
+func Instrument(m *Metrics) Decorator {
+	return observe(m.record)
+}
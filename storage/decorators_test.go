@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+
+	"deck-of-cards/deck"
+)
+
+// recording remembers the order decorators see calls in
+func recording(name string, calls *[]string) Decorator {
+	return observe(func(method string, id uuid.UUID, took time.Duration, err error) {
+		*calls = append(*calls, name+"."+method)
+	})
+}
+
+func TestChainWrapsFirstDecoratorOutermost(t *testing.T) {
+	var calls []string
+	st := Chain(NewInMemoryStorage(), recording("outer", &calls), recording("inner", &calls))
+	st.GetDeck(context.Background(), uuid.New())
+
+	// observers run after the call returns, so the innermost one goes first
+	expected := []string{"inner.GetDeck", "outer.GetDeck"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+}
+
+func TestInstrumentCountsCallsAndErrors(t *testing.T) {
+	m := NewMetrics()
+	st := Instrument(m)(NewInMemoryStorage())
+	ctx := context.Background()
+
+	d := deck.NewDeck(uuid.New(), false, nil)
+	_ = st.SaveDeck(ctx, *d)
+	st.GetDeck(ctx, d.ID)
+	st.GetDeck(ctx, d.ID)
+	_ = st.DeleteDeck(ctx, d.ID)
+	_ = st.DeleteDeck(ctx, d.ID)
+
+	stats := m.Stats()
+	expected := map[string][2]int64{
+		"SaveDeck":   {1, 0},
+		"GetDeck":    {2, 0},
+		"DeleteDeck": {2, 1},
+	}
+	if len(stats) != len(expected) {
+		t.Errorf("Expected stats for %d methods, got %v", len(expected), stats)
+	}
+	for method, counts := range expected {
+		s := stats[method]
+		if s.Calls != counts[0] || s.Errors != counts[1] {
+			t.Errorf("Expected %s to have %d calls and %d errors, got %+v", method, counts[0], counts[1], s)
+		}
+		if s.Total < s.Max {
+			t.Errorf("Expected total latency of %s to cover the slowest call, got %+v", method, s)
+		}
+	}
+}
+
+// failingStorage fails every write, to tell expected errors from failures
+type failingStorage struct {
+	DeckStorage
+}
+
+func (failingStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	return errors.New("disk full")
+}
+
+func TestLoggingLogsEveryCallWithDeckID(t *testing.T) {
+	id := uuid.New()
+	d := deck.NewDeck(id, false, nil)
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	st := Logging(logrus.DebugLevel)(failingStorage{NewInMemoryStorage()})
+	ctx := context.Background()
+	st.GetDeck(ctx, id)
+	_ = st.DeleteDeck(ctx, id)
+	_ = st.SaveDeck(ctx, *d)
+	_, _ = st.List(ctx, ListFilter{}, "")
+
+	expected := []struct {
+		method string
+		level  logrus.Level
+	}{
+		{"GetDeck", logrus.DebugLevel},
+		{"DeleteDeck", logrus.DebugLevel},
+		{"SaveDeck", logrus.ErrorLevel},
+		{"List", logrus.DebugLevel},
+	}
+	if len(hook.Entries) != len(expected) {
+		t.Fatalf("Expected %d log entries, got %d", len(expected), len(hook.Entries))
+	}
+	for i, e := range expected {
+		entry := hook.Entries[i]
+		if entry.Data["method"] != e.method || entry.Level != e.level {
+			t.Errorf("Expected %s logged at %s, got %v at %s", e.method, e.level, entry.Data["method"], entry.Level)
+		}
+		if _, found := entry.Data["deck_id"]; found != (e.method != "List") {
+			t.Errorf("Unexpected deck_id in %s log entry: %v", e.method, entry.Data)
+		}
+	}
+}
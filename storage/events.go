@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"deck-of-cards/deck"
+)
+
+type actorKey struct{}
+
+// WithActor attaches whoever makes the request to ctx, storage records them
+// on the events written with ctx
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// takeEvents takes the events recorded on d since it was read off the deck,
+// recording the actor from ctx on those which don't have one yet. Storage
+// appends them to the history of the deck, which it keeps apart from the
+// deck, so writes don't grow with the history
+func takeEvents(ctx context.Context, d *deck.Deck) []deck.Event {
+	events := d.TakeEvents()
+	actor := ActorFromContext(ctx)
+	if actor == "" || len(events) == 0 {
+		return events
+	}
+	// the events may be shared with the caller's deck
+	events = append([]deck.Event(nil), events...)
+	for i := range events {
+		if events[i].Actor == "" {
+			events[i].Actor = actor
+		}
+	}
+	return events
+}
+
+// appendEvents puts the events into the history from index from on, dropping
+// whatever came after it, like the events of a write which failed halfway
+// or the history of a deck saved over. The dropped events are never
+// overwritten in place, snapshots may still be encoding them
+func appendEvents(history []deck.Event, from int, events []deck.Event) []deck.Event {
+	from = max(0, min(from, len(history)))
+	if from < len(history) {
+		return append(history[:from:from], events...)
+	}
+	return append(history, events...)
+}
+
+// withHistory returns the deck along with all its events, the way
+// DeckHistory hands it out. Events beyond the recorded ones belong to writes
+// which failed halfway, and decks written before events were kept apart
+// still carry their own
+func withHistory(d deck.Deck, history []deck.Event) deck.Deck {
+	history = history[:min(len(history), d.RecordedEvents)]
+	d.Events = slices.Concat(history, d.Events)
+	d.RecordedEvents = 0
+	return d
+}
+
+// tombstone remembers a deleted deck for a while, its history is kept
+// until the tombstone is purged
+type tombstone struct {
+	DeletedAt time.Time `json:"deleted_at"`
+	Deck      deck.Deck `json:"deck"`
+}
+
+// newTombstone returns the tombstone of d along with the deletion event
+func newTombstone(ctx context.Context, d deck.Deck, deletedAt time.Time) (tombstone, []deck.Event) {
+	d.MarkDeleted()
+	events := takeEvents(ctx, &d)
+	return tombstone{DeletedAt: deletedAt, Deck: d}, events
+}
@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/deck"
+)
+
+const (
+	deckFileExt      = ".json"
+	tombstoneFileExt = ".deleted"
+	eventsFileExt    = ".events"
+)
+
+// FileStorage keeps every deck as a JSON file in a directory, so decks
+// survive restarts. Files are replaced atomically: a deck is written to a
+// temporary file, synced to disk and renamed over the old one, so a crash
+// never leaves a half-written deck behind. The history of a deck is a file
+// of newline-delimited events next to it, which writes append to.
+//
+// The directory must not be shared between processes
+type FileStorage struct {
+	settings Settings
+	dir      string
+	mu       sync.Mutex
+}
+
+func NewFileStorage(dir string, opts ...Option) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %w", err)
+	}
+	return &FileStorage{settings: ApplyOptions(opts...), dir: dir}, nil
+}
+
+func (s *FileStorage) deckPath(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+deckFileExt)
+}
+
+func (s *FileStorage) tombstonePath(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+tombstoneFileExt)
+}
+
+func (s *FileStorage) eventsPath(id uuid.UUID) string {
+	return filepath.Join(s.dir, id.String()+eventsFileExt)
+}
+
+func readDeckFile(path string) (deck.Deck, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	var d deck.Deck
+	if err := json.Unmarshal(data, &d); err != nil {
+		return deck.Deck{}, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return d, nil
+}
+
+// should be called with the lock held. Like in memory, expired decks are
+// evicted on lookup
+func (s *FileStorage) lookup(id uuid.UUID) (deck.Deck, error) {
+	d, err := readDeckFile(s.deckPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return deck.Deck{}, s.notFound(id)
+	}
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	if s.settings.Expired(d) {
+		if err := os.Remove(s.deckPath(id)); err != nil {
+			return deck.Deck{}, err
+		}
+		s.removeEvents(id)
+		return deck.Deck{}, s.notFound(id)
+	}
+	return d, nil
+}
+
+// should be called with the lock held
+func (s *FileStorage) writeDeck(d deck.Deck) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.dir, s.deckPath(d.ID), data)
+}
+
+func encodeEvents(events []deck.Event) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// should be called with the lock held, replaces the history of the deck
+func (s *FileStorage) writeEvents(id uuid.UUID, events []deck.Event) error {
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.dir, s.eventsPath(id), data)
+}
+
+// should be called with the lock held. Every append starts on a new line,
+// so a line torn by a crash doesn't swallow the first event after it
+func (s *FileStorage) appendEvents(id uuid.UUID, events []deck.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	data, err := encodeEvents(events)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.eventsPath(id), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append([]byte("\n"), data...)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// should be called with the lock held. Events go to their index, so the
+// events of a write which failed halfway are replaced by the next write,
+// and lines torn by a crash are skipped
+func (s *FileStorage) readEvents(id uuid.UUID) ([]deck.Event, error) {
+	data, err := os.ReadFile(s.eventsPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var events []deck.Event
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var e deck.Event
+		if len(line) == 0 || json.Unmarshal(line, &e) != nil {
+			continue
+		}
+		events = appendEvents(events, e.Index, []deck.Event{e})
+	}
+	return events, nil
+}
+
+// should be called with the lock held
+func (s *FileStorage) removeEvents(id uuid.UUID) {
+	if err := os.Remove(s.eventsPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logrus.WithError(err).WithField("deck_id", id).Error("Error removing deck history")
+	}
+}
+
+// should be called with the lock held
+func (s *FileStorage) notFound(id uuid.UUID) error {
+	return notFound(id, s.tombstoned(id))
+}
+
+// should be called with the lock held, purges the tombstone if it's expired
+func (s *FileStorage) readTombstone(id uuid.UUID) (tombstone, bool) {
+	data, err := os.ReadFile(s.tombstonePath(id))
+	if err != nil {
+		return tombstone{}, false
+	}
+	var t tombstone
+	if err := json.Unmarshal(data, &t); err != nil || s.settings.TombstoneExpired(t.DeletedAt) {
+		os.Remove(s.tombstonePath(id))
+		s.removeEvents(id)
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+// should be called with the lock held
+func (s *FileStorage) tombstoned(id uuid.UUID) bool {
+	_, found := s.readTombstone(id)
+	return found
+}
+
+// should be called with the lock held
+func (s *FileStorage) purgeTombstones() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		logrus.WithError(err).Error("Error reading storage directory")
+		return
+	}
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), tombstoneFileExt)
+		if !found {
+			continue
+		}
+		if id, err := uuid.Parse(name); err == nil {
+			s.tombstoned(id)
+		}
+	}
+}
+
+// should be called with the lock held, calls fn for every deck in the
+// directory. Files which can't be read are logged and skipped, so one broken
+// deck doesn't take every listing down with it
+func (s *FileStorage) forEachDeck(fn func(path string, d deck.Deck)) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), deckFileExt) {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		d, err := readDeckFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("path", path).Error("Error reading deck file")
+			continue
+		}
+		fn(path, d)
+	}
+	return nil
+}
+
+func (s *FileStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.tombstonePath(d.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// the deck brings its whole history, which replaces the stored one
+	d.RecordedEvents = 0
+	if err := s.writeEvents(d.ID, takeEvents(ctx, &d)); err != nil {
+		return err
+	}
+	return s.writeDeck(d)
+}
+
+func (s *FileStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.lookup(id)
+	if err != nil {
+		if !errors.Is(err, ErrDeckNotFound) {
+			logrus.WithError(err).WithField("deck_id", id).Error("Error reading deck")
+		}
+		return deck.Deck{}, false
+	}
+	if s.settings.TouchRead(&d) {
+		if err := s.writeDeck(d); err != nil {
+			logrus.WithError(err).WithField("deck_id", id).Error("Error recording deck access")
+		}
+	}
+	return d, true
+}
+
+func (s *FileStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.lookup(id)
+	if err != nil {
+		return err
+	}
+	t, events := newTombstone(ctx, d, s.settings.Now().UTC())
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := s.appendEvents(id, events); err != nil {
+		return err
+	}
+	// the tombstone goes first, so a crash in between doesn't lose the history
+	if err := writeFileAtomic(s.dir, s.tombstonePath(id), data); err != nil {
+		return err
+	}
+	return os.Remove(s.deckPath(id))
+}
+
+func (s *FileStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tombstoned(id)
+}
+
+func (s *FileStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.lookup(d.ID)
+	if err != nil {
+		return err
+	}
+	if stored.Version != d.Version {
+		return &ConflictError{ID: d.ID, Expected: d.Version, Actual: stored.Version}
+	}
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	if err := s.appendEvents(d.ID, events); err != nil {
+		return err
+	}
+	return s.writeDeck(d)
+}
+
+func (s *FileStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.lookup(id)
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	if err := fn(&d); err != nil {
+		return deck.Deck{}, err
+	}
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	if err := s.appendEvents(id, events); err != nil {
+		return deck.Deck{}, err
+	}
+	if err := s.writeDeck(d); err != nil {
+		return deck.Deck{}, err
+	}
+	return d, nil
+}
+
+func (s *FileStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+	after, err := ParseCursor(cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	s.mu.Lock()
+	var matched []deck.Deck
+	err = s.forEachDeck(func(path string, d deck.Deck) {
+		if !s.settings.Expired(d) && filter.Match(d) && after.Less(CursorOf(d)) {
+			matched = append(matched, d)
+		}
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	return paginate(matched, filter), nil
+}
+
+func (s *FileStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.lookup(id)
+	if errors.Is(err, ErrDeckNotFound) {
+		t, found := s.readTombstone(id)
+		if !found {
+			return deck.Deck{}, err
+		}
+		d, err = t.Deck, nil
+	}
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	events, err := s.readEvents(id)
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	return withHistory(d, events), nil
+}
+
+// EvictExpired removes the files of decks which were not used for longer
+// than their TTL along with expired tombstones, and returns the number of
+// evicted decks
+func (s *FileStorage) EvictExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := 0
+	err := s.forEachDeck(func(path string, d deck.Deck) {
+		if !s.settings.Expired(d) {
+			return
+		}
+		if err := os.Remove(path); err != nil {
+			logrus.WithError(err).WithField("deck_id", d.ID).Error("Error evicting deck")
+			return
+		}
+		s.removeEvents(d.ID)
+		evicted++
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Error reading storage directory")
+	}
+	s.purgeTombstones()
+	return evicted
+}
+
+// RunJanitor evicts expired decks every interval until ctx is cancelled
+func (s *FileStorage) RunJanitor(ctx context.Context, interval time.Duration) {
+	runJanitor(ctx, interval, s.EvictExpired)
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+)
+
+func TestFileStorageSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err)
+	}
+
+	d, err := s.MutateDeck(ctx, saveDeck(t, s, true).ID, func(d *deck.Deck) error {
+		d.Draw(5)
+		return d.MoveToPile("discard", []string{d.Cards[0].Code})
+	})
+	if err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	deleted := saveDeck(t, s, false)
+	if err := s.DeleteDeck(ctx, deleted.ID); err != nil {
+		t.Fatalf("DeleteDeck failed: %s", err)
+	}
+
+	reopened, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err)
+	}
+	dd, found := reopened.GetDeck(ctx, d.ID)
+	if !found {
+		t.Fatalf("Deck was lost on restart")
+	}
+	d.LastAccessedAt = dd.LastAccessedAt
+	if !reflect.DeepEqual(d, dd) {
+		t.Errorf("Deck changed on restart:\n%+v\n%+v", d, dd)
+	}
+	if !reopened.DeckDeleted(ctx, deleted.ID) {
+		t.Errorf("Tombstone was lost on restart")
+	}
+}
+
+func TestFileStorageLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir, WithTTL(time.Hour))
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err)
+	}
+	d := saveDeck(t, s, true)
+	if _, err := s.MutateDeck(context.Background(), d.ID, func(d *deck.Deck) error {
+		d.Draw(1)
+		return nil
+	}); err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading storage directory: %s", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{d.ID.String() + eventsFileExt, d.ID.String() + deckFileExt}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected only the deck and its history in storage directory, got %v", names)
+	}
+}
+
+// a crash while appending to the history leaves events behind which the
+// deck doesn't count, the next write replaces them
+func TestFileStorageReplacesEventsOfFailedWrites(t *testing.T) {
+	s, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err)
+	}
+	d := saveDeck(t, s, false)
+
+	failed := d.Clone()
+	failed.Shuffle()
+	if err := s.appendEvents(d.ID, failed.TakeEvents()); err != nil {
+		t.Fatalf("Error appending events: %s", err)
+	}
+	f, err := os.OpenFile(s.eventsPath(d.ID), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Error opening history: %s", err)
+	}
+	f.WriteString(`{"index":2,"type":"dra`)
+	f.Close()
+
+	h, _ := s.DeckHistory(context.Background(), d.ID)
+	if len(h.Events) != 1 {
+		t.Fatalf("Expected events the deck doesn't count to be left out, got %d events", len(h.Events))
+	}
+	drawOne(t, s, d.ID)
+	h, _ = s.DeckHistory(context.Background(), d.ID)
+	if len(h.Events) != 2 || h.Events[1].Type != deck.EventDrawn {
+		t.Errorf("Expected the draw to replace the failed shuffle, got %+v", h.Events)
+	}
+}
+
+func TestFileStorageReportsCorruptDecks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %s", err)
+	}
+	id := uuid.New()
+	if err := os.WriteFile(filepath.Join(dir, id.String()+deckFileExt), []byte(`{"deck_id":`), 0o644); err != nil {
+		t.Fatalf("Error writing corrupt deck: %s", err)
+	}
+
+	_, err = s.MutateDeck(context.Background(), id, func(d *deck.Deck) error { return nil })
+	if err == nil || errors.Is(err, ErrDeckNotFound) {
+		t.Errorf("Expected decoding error for corrupt deck, got %v", err)
+	}
+
+	// the other decks are still listed
+	kept := saveDeck(t, s, false)
+	page, err := s.List(context.Background(), ListFilter{}, "")
+	if err != nil || len(page.Decks) != 1 || page.Decks[0].ID != kept.ID {
+		t.Errorf("Expected List to skip the corrupt deck, got %d decks (%v)", len(page.Decks), err)
+	}
+}
+
+func saveDeck(t *testing.T, s DeckStorage, shuffle bool) deck.Deck {
+	t.Helper()
+	d := deck.NewDeck(uuid.New(), shuffle, nil)
+	if err := s.SaveDeck(context.Background(), *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	// as stored, without its events
+	d.TakeEvents()
+	return *d
+}
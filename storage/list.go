@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListFilter narrows down the decks returned by List, zero values match everything
+type ListFilter struct {
+	// RemainingLessThan keeps decks with fewer cards left in them
+	RemainingLessThan *int
+	Shuffled          *bool
+	CreatedAfter      time.Time
+	// Limit is the page size, DefaultListLimit when zero, capped at MaxListLimit
+	Limit int
+}
+
+func (f ListFilter) Match(d deck.Deck) bool {
+	if f.RemainingLessThan != nil && len(d.Cards) >= *f.RemainingLessThan {
+		return false
+	}
+	if f.Shuffled != nil && d.Shuffled != *f.Shuffled {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && !d.CreatedAt.After(f.CreatedAfter) {
+		return false
+	}
+	return true
+}
+
+func (f ListFilter) PageSize() int {
+	if f.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(f.Limit, MaxListLimit)
+}
+
+// ListPage is a page of decks ordered by creation time
+type ListPage struct {
+	Decks []deck.Deck
+	// NextCursor continues the listing after this page, empty on the last page
+	NextCursor string
+}
+
+// Cursor is the position of a deck in the listing order: creation time, then ID
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+func CursorOf(d deck.Deck) Cursor {
+	return Cursor{CreatedAt: d.CreatedAt, ID: d.ID}
+}
+
+// Less reports whether c comes before other in the listing order
+func (c Cursor) Less(other Cursor) bool {
+	if !c.CreatedAt.Equal(other.CreatedAt) {
+		return c.CreatedAt.Before(other.CreatedAt)
+	}
+	return strings.Compare(c.ID.String(), other.ID.String()) < 0
+}
+
+// String encodes the cursor into an opaque token for clients
+func (c Cursor) String() string {
+	raw := strconv.FormatInt(c.CreatedAt.UnixNano(), 10) + ":" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token made by Cursor.String. The empty token is
+// the zero cursor, which starts the listing from the beginning
+func ParseCursor(token string) (Cursor, error) {
+	if token == "" {
+		return Cursor{}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return Cursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	parsedID, err := uuid.Parse(id)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	return Cursor{CreatedAt: time.Unix(0, n).UTC(), ID: parsedID}, nil
+}
+
+// paginate sorts the matched decks in listing order and cuts the first page
+func paginate(matched []deck.Deck, filter ListFilter) ListPage {
+	sort.Slice(matched, func(i, j int) bool {
+		return CursorOf(matched[i]).Less(CursorOf(matched[j]))
+	})
+
+	var page ListPage
+	if size := filter.PageSize(); len(matched) > size {
+		matched = matched[:size]
+		page.NextCursor = CursorOf(matched[size-1]).String()
+	}
+	page.Decks = matched
+	return page
+}
@@ -0,0 +1,26 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 42, time.UTC), ID: uuid.New()}
+	parsed, err := ParseCursor(c.String())
+	if err != nil {
+		t.Fatalf("ParseCursor failed: %s", err)
+	}
+	if !parsed.CreatedAt.Equal(c.CreatedAt) || parsed.ID != c.ID {
+		t.Errorf("Expected cursor %+v, got %+v", c, parsed)
+	}
+
+	for _, token := range []string{"not base64!", "bm8tY29sb24", "eDo2YmEyNTg1OC1kYjcxLTRkNWMtYTcwNS1hN2E2ZjNmZmYyZmQ"} {
+		if _, err := ParseCursor(token); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("Expected ErrInvalidCursor for %q, got %v", token, err)
+		}
+	}
+}
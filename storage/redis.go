@@ -0,0 +1,546 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/deck"
+)
+
+const (
+	// decks are hashes with the JSON encoded deck in "data", its version in
+	// "version", so scripts can check the version without decoding the deck,
+	// and its index member in "member"
+	redisDeckKeyPrefix      = "deck:"
+	redisTombstoneKeyPrefix = "tombstone:"
+	// histories are lists of JSON encoded events, which expire along with
+	// the deck or its tombstone
+	redisEventsKeyPrefix = "events:"
+	// redisIndexKey is a sorted set of "<created_at>:<id>" members, all with
+	// score 0, so ranging over it by lex lists decks in creation order
+	redisIndexKey = "decks:index"
+)
+
+// redisAppendEvents is shared by the scripts, it ends the history at index
+// from with the events in ARGV from index first on
+const redisAppendEvents = `
+local function append_events(key, from, first)
+	if from > 0 then
+		redis.call('LTRIM', key, 0, from - 1)
+	else
+		redis.call('DEL', key)
+	end
+	if #ARGV >= first then
+		redis.call('RPUSH', key, unpack(ARGV, first))
+	end
+end
+`
+
+// swaps the deck if its version still matches, returns -1 for missing decks,
+// the stored version on conflicts and 0 on success
+//
+// KEYS[1] deck, KEYS[2] events, ARGV[1] expected version, ARGV[2] new
+// version, ARGV[3] data, ARGV[4] TTL in milliseconds, 0 keeps the deck
+// forever, ARGV[5] index of the first new event, ARGV[6...] new events
+var redisSwapScript = redis.NewScript(redisAppendEvents + `
+local current = redis.call('HGET', KEYS[1], 'version')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return tonumber(current)
+end
+redis.call('HSET', KEYS[1], 'data', ARGV[3], 'version', ARGV[2])
+append_events(KEYS[2], tonumber(ARGV[5]), 6)
+for _, key in ipairs(KEYS) do
+	if tonumber(ARGV[4]) > 0 then
+		redis.call('PEXPIRE', key, ARGV[4])
+	else
+		redis.call('PERSIST', key)
+	end
+end
+return 0
+`)
+
+// saves the deck over whatever was stored under its ID, its history and
+// tombstone included. The index member of the stored deck is replaced too,
+// decks saved over with another creation time would be listed twice otherwise
+//
+// KEYS[1] deck, KEYS[2] tombstone, KEYS[3] index, KEYS[4] events, ARGV[1]
+// data, ARGV[2] version, ARGV[3] index member, ARGV[4] TTL in milliseconds,
+// 0 keeps the deck forever, ARGV[5] index of the first event, always 0,
+// ARGV[6...] events
+var redisSaveScript = redis.NewScript(redisAppendEvents + `
+local stale = redis.call('HGET', KEYS[1], 'member')
+if stale and stale ~= ARGV[3] then
+	redis.call('ZREM', KEYS[3], stale)
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('HSET', KEYS[1], 'data', ARGV[1], 'version', ARGV[2], 'member', ARGV[3])
+append_events(KEYS[4], tonumber(ARGV[5]), 6)
+if tonumber(ARGV[4]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+	redis.call('PEXPIRE', KEYS[4], ARGV[4])
+end
+redis.call('ZADD', KEYS[3], 0, ARGV[3])
+return 0
+`)
+
+// deletes the deck if its version still matches and leaves a tombstone
+// unless ARGV[3] is empty, returns the same codes as redisSwapScript. The
+// history stays along with the tombstone
+//
+// KEYS[1] deck, KEYS[2] tombstone, KEYS[3] index, KEYS[4] events, ARGV[1]
+// expected version, ARGV[2] index member, ARGV[3] tombstone, ARGV[4]
+// tombstone TTL in milliseconds, ARGV[5] index of the deletion event,
+// ARGV[6] deletion event
+var redisDeleteScript = redis.NewScript(redisAppendEvents + `
+local current = redis.call('HGET', KEYS[1], 'version')
+if not current then
+	return -1
+end
+if current ~= ARGV[1] then
+	return tonumber(current)
+end
+redis.call('DEL', KEYS[1])
+redis.call('ZREM', KEYS[3], ARGV[2])
+if ARGV[3] == '' then
+	redis.call('DEL', KEYS[4])
+	return 0
+end
+redis.call('SET', KEYS[2], ARGV[3], 'PX', ARGV[4])
+append_events(KEYS[4], tonumber(ARGV[5]), 6)
+redis.call('PEXPIRE', KEYS[4], ARGV[4])
+return 0
+`)
+
+// RedisStorage keeps decks in Redis, so several instances of the service
+// can share them. Writes are compare-and-swap Lua scripts on the deck
+// version, which makes them atomic across instances, and deck keys expire
+// along with the decks
+type RedisStorage struct {
+	settings Settings
+	client   *redis.Client
+}
+
+// NewRedisStorage keeps decks in the Redis behind client, which may be a
+// failover client too. Redis Cluster is not supported, the scripts touch
+// the deck, its tombstone, its history and the index, which live in
+// different slots
+func NewRedisStorage(client *redis.Client, opts ...Option) *RedisStorage {
+	return &RedisStorage{settings: ApplyOptions(opts...), client: client}
+}
+
+func redisDeckKey(id uuid.UUID) string {
+	return redisDeckKeyPrefix + id.String()
+}
+
+func redisTombstoneKey(id uuid.UUID) string {
+	return redisTombstoneKeyPrefix + id.String()
+}
+
+func redisEventsKey(id uuid.UUID) string {
+	return redisEventsKeyPrefix + id.String()
+}
+
+// redisEventArgs adds the events, which were taken off d, to the arguments
+// of a script after the index of the first of them
+func redisEventArgs(args []any, d deck.Deck, events []deck.Event) ([]any, error) {
+	args = append(args, d.RecordedEvents-len(events))
+	for _, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, data)
+	}
+	return args, nil
+}
+
+func redisIndexMember(d deck.Deck) string {
+	return fmt.Sprintf("%020d:%s", d.CreatedAt.UnixNano(), d.ID)
+}
+
+func decodeRedisDeck(data string) (deck.Deck, error) {
+	var d deck.Deck
+	err := json.Unmarshal([]byte(data), &d)
+	return d, err
+}
+
+// expired decks are evicted on lookup even before Redis expires them, so
+// the storage behaves the same regardless of whose clock runs ahead
+func (s *RedisStorage) lookup(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	data, err := s.client.HGet(ctx, redisDeckKey(id), "data").Result()
+	if errors.Is(err, redis.Nil) {
+		return deck.Deck{}, s.notFound(ctx, id)
+	}
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	d, err := decodeRedisDeck(data)
+	if err != nil {
+		return deck.Deck{}, fmt.Errorf("decoding deck with id=%v: %w", id, err)
+	}
+	if s.settings.Expired(d) {
+		if _, err := s.evict(ctx, d); err != nil {
+			return deck.Deck{}, err
+		}
+		return deck.Deck{}, s.notFound(ctx, id)
+	}
+	return d, nil
+}
+
+func (s *RedisStorage) notFound(ctx context.Context, id uuid.UUID) error {
+	return notFound(id, s.tombstoned(ctx, id))
+}
+
+// tombstone keys expire by themselves, the deletion time is still checked
+// for the same reason as in lookup
+func (s *RedisStorage) readTombstone(ctx context.Context, id uuid.UUID) (tombstone, bool) {
+	data, err := s.client.Get(ctx, redisTombstoneKey(id)).Result()
+	if err != nil {
+		return tombstone{}, false
+	}
+	var t tombstone
+	if err := json.Unmarshal([]byte(data), &t); err != nil || s.settings.TombstoneExpired(t.DeletedAt) {
+		return tombstone{}, false
+	}
+	return t, true
+}
+
+func (s *RedisStorage) tombstoned(ctx context.Context, id uuid.UUID) bool {
+	_, found := s.readTombstone(ctx, id)
+	return found
+}
+
+// swap writes d along with the events taken off it if the stored version is
+// still expected
+func (s *RedisStorage) swap(ctx context.Context, d deck.Deck, events []deck.Event, expected int64) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	args, err := redisEventArgs([]any{expected, d.Version, data, s.settings.DeckTTL(d).Milliseconds()}, d, events)
+	if err != nil {
+		return err
+	}
+	keys := []string{redisDeckKey(d.ID), redisEventsKey(d.ID)}
+	result, err := redisSwapScript.Run(ctx, s.client, keys, args...).Int64()
+	if err != nil {
+		return err
+	}
+	return s.scriptResult(ctx, d.ID, expected, result)
+}
+
+// evict deletes the deck without a tombstone, unless it was changed meanwhile
+func (s *RedisStorage) evict(ctx context.Context, d deck.Deck) (bool, error) {
+	keys := []string{redisDeckKey(d.ID), redisTombstoneKey(d.ID), redisIndexKey, redisEventsKey(d.ID)}
+	result, err := redisDeleteScript.Run(ctx, s.client, keys, d.Version, redisIndexMember(d), "", 0, 0).Int64()
+	return result == 0, err
+}
+
+func (s *RedisStorage) scriptResult(ctx context.Context, id uuid.UUID, expected, result int64) error {
+	switch {
+	case result < 0:
+		return s.notFound(ctx, id)
+	case result > 0:
+		return &ConflictError{ID: id, Expected: expected, Actual: result}
+	}
+	return nil
+}
+
+const (
+	retryMinBackoff = time.Millisecond
+	retryMaxBackoff = 100 * time.Millisecond
+)
+
+// retry runs fn until it doesn't fail with a conflict, which happens when
+// another request or instance changed the deck between the read and the write.
+// It waits a random time before every retry, up to twice as long as before,
+// so requests racing on the same deck don't keep running into each other
+func retry(ctx context.Context, fn func() error) error {
+	backoff := retryMinBackoff
+	for {
+		err := fn()
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+		timer := time.NewTimer(rand.N(backoff) + 1)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, retryMaxBackoff)
+	}
+}
+
+func (s *RedisStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// the deck brings its whole history, which replaces the stored one
+	d.RecordedEvents = 0
+	events := takeEvents(ctx, &d)
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	args, err := redisEventArgs([]any{data, d.Version, redisIndexMember(d), s.settings.DeckTTL(d).Milliseconds()}, d, events)
+	if err != nil {
+		return err
+	}
+	keys := []string{redisDeckKey(d.ID), redisTombstoneKey(d.ID), redisIndexKey, redisEventsKey(d.ID)}
+	return redisSaveScript.Run(ctx, s.client, keys, args...).Err()
+}
+
+func (s *RedisStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	var d deck.Deck
+	err := retry(ctx, func() error {
+		var err error
+		if d, err = s.lookup(ctx, id); err != nil {
+			return err
+		}
+		if !s.settings.TouchRead(&d) {
+			return nil
+		}
+		return s.swap(ctx, d, nil, d.Version)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrDeckNotFound) {
+			logrus.WithError(err).WithField("deck_id", id).Error("Error reading deck")
+		}
+		return deck.Deck{}, false
+	}
+	return d, true
+}
+
+func (s *RedisStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return retry(ctx, func() error {
+		d, err := s.lookup(ctx, id)
+		if err != nil {
+			return err
+		}
+		t, events := newTombstone(ctx, d, s.settings.Now().UTC())
+		data, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		// SET with PX 0 fails, but such tombstones would be expired right away anyway
+		tombstoneTTL := max(s.settings.TombstoneTTL.Milliseconds(), 1)
+		args, err := redisEventArgs([]any{d.Version, redisIndexMember(d), data, tombstoneTTL}, t.Deck, events)
+		if err != nil {
+			return err
+		}
+		keys := []string{redisDeckKey(id), redisTombstoneKey(id), redisIndexKey, redisEventsKey(id)}
+		result, err := redisDeleteScript.Run(ctx, s.client, keys, args...).Int64()
+		if err != nil {
+			return err
+		}
+		return s.scriptResult(ctx, id, d.Version, result)
+	})
+}
+
+func (s *RedisStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	return s.tombstoned(ctx, id)
+}
+
+func (s *RedisStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, err := s.lookup(ctx, d.ID); err != nil {
+		return err
+	}
+	expected := d.Version
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	return s.swap(ctx, d, events, expected)
+}
+
+// MutateDeck reads the deck, applies fn and writes it back if nobody else
+// changed it meanwhile, otherwise it starts over with the fresh deck, so fn
+// may be called more than once
+func (s *RedisStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	var d deck.Deck
+	err := retry(ctx, func() error {
+		var err error
+		if d, err = s.lookup(ctx, id); err != nil {
+			return err
+		}
+		expected := d.Version
+		if err := fn(&d); err != nil {
+			return err
+		}
+		events := takeEvents(ctx, &d)
+		s.settings.Touch(&d)
+		d.Version++
+		return s.swap(ctx, d, events, expected)
+	})
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	return d, nil
+}
+
+func (s *RedisStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	d, err := s.lookup(ctx, id)
+	if errors.Is(err, ErrDeckNotFound) {
+		t, found := s.readTombstone(ctx, id)
+		if !found {
+			return deck.Deck{}, err
+		}
+		d, err = t.Deck, nil
+	}
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	// writes meanwhile only append to the history, which withHistory cuts
+	// off at the events recorded for d
+	encoded, err := s.client.LRange(ctx, redisEventsKey(id), 0, -1).Result()
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	events := make([]deck.Event, len(encoded))
+	for i, data := range encoded {
+		if err := json.Unmarshal([]byte(data), &events[i]); err != nil {
+			return deck.Deck{}, fmt.Errorf("decoding event of deck with id=%v: %w", id, err)
+		}
+	}
+	return withHistory(d, events), nil
+}
+
+// scan calls fn with every indexed deck in creation order, starting after
+// the member, until fn returns false. Index entries of decks which Redis
+// already expired are removed on the way
+func (s *RedisStorage) scan(ctx context.Context, after string, batch int, fn func(d deck.Deck) bool) error {
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	for {
+		members, err := s.client.ZRangeByLex(ctx, redisIndexKey, &redis.ZRangeBy{Min: start, Max: "+", Count: int64(batch)}).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		cmds := make([]*redis.StringCmd, len(members))
+		_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, member := range members {
+				_, id, _ := strings.Cut(member, ":")
+				cmds[i] = pipe.HGet(ctx, redisDeckKeyPrefix+id, "data")
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+
+		for i, cmd := range cmds {
+			data, err := cmd.Result()
+			if errors.Is(err, redis.Nil) {
+				s.client.ZRem(ctx, redisIndexKey, members[i])
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			d, err := decodeRedisDeck(data)
+			if err != nil {
+				return fmt.Errorf("decoding deck %s: %w", members[i], err)
+			}
+			// members of decks saved over after Redis expired them, or
+			// before their hash kept the member, are left behind
+			if redisIndexMember(d) != members[i] {
+				s.client.ZRem(ctx, redisIndexKey, members[i])
+				continue
+			}
+			if !fn(d) {
+				return nil
+			}
+		}
+		start = "(" + members[len(members)-1]
+	}
+}
+
+func (s *RedisStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+	after, err := ParseCursor(cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+	var afterMember string
+	if cursor != "" {
+		afterMember = redisIndexMember(deck.Deck{ID: after.ID, CreatedAt: after.CreatedAt})
+	}
+
+	// one more deck than the page size tells whether there is a next page
+	size := filter.PageSize()
+	var matched []deck.Deck
+	err = s.scan(ctx, afterMember, size+1, func(d deck.Deck) bool {
+		if !s.settings.Expired(d) && filter.Match(d) {
+			matched = append(matched, d)
+		}
+		return len(matched) <= size
+	})
+	if err != nil {
+		return ListPage{}, err
+	}
+	return paginate(matched, filter), nil
+}
+
+// EvictExpired deletes decks which were not used for longer than their TTL
+// and returns the number of evicted decks. Redis expires deck keys by itself,
+// so this mostly cleans up index entries left behind by them
+func (s *RedisStorage) EvictExpired() int {
+	ctx := context.Background()
+	evicted := 0
+	err := s.scan(ctx, "", 100, func(d deck.Deck) bool {
+		if !s.settings.Expired(d) {
+			return true
+		}
+		deleted, err := s.evict(ctx, d)
+		if err != nil {
+			logrus.WithError(err).WithField("deck_id", d.ID).Error("Error evicting deck")
+		}
+		if deleted {
+			evicted++
+		}
+		return true
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Error evicting expired decks")
+	}
+	return evicted
+}
+
+// RunJanitor evicts expired decks every interval until ctx is cancelled
+func (s *RedisStorage) RunJanitor(ctx context.Context, interval time.Duration) {
+	runJanitor(ctx, interval, s.EvictExpired)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"deck-of-cards/deck"
+)
+
+func newTestRedisStorage(t *testing.T, mr *miniredis.Miniredis, opts ...Option) *RedisStorage {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisStorage(client, opts...)
+}
+
+func TestRedisStorageKeyTTLFollowsDeck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	now := time.Now()
+	s := newTestRedisStorage(t, mr, WithTTL(time.Hour), WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+
+	d := saveDeck(t, s, false)
+	short := deck.NewDeck(uuid.New(), false, nil, deck.WithTTL(time.Minute))
+	if err := s.SaveDeck(ctx, *short); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	if ttl := mr.TTL(redisDeckKey(d.ID)); ttl != time.Hour {
+		t.Errorf("Expected deck key to expire in an hour, got %v", ttl)
+	}
+	if ttl := mr.TTL(redisDeckKey(short.ID)); ttl != time.Minute {
+		t.Errorf("Expected deck key to expire with the deck TTL, got %v", ttl)
+	}
+
+	// using the deck pushes the expiry back
+	mr.FastForward(30 * time.Minute)
+	now = now.Add(30 * time.Minute)
+	if _, found := s.GetDeck(ctx, d.ID); !found {
+		t.Fatalf("Deck expired before its TTL")
+	}
+	if ttl := mr.TTL(redisDeckKey(d.ID)); ttl != time.Hour {
+		t.Errorf("Expected deck key expiry to be refreshed, got %v", ttl)
+	}
+
+	// decks expired by Redis are dropped from the listing index
+	mr.FastForward(2 * time.Minute)
+	now = now.Add(2 * time.Minute)
+	page, err := s.List(ctx, ListFilter{}, "")
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	if len(page.Decks) != 1 || page.Decks[0].ID != d.ID {
+		t.Errorf("Expected only the unexpired deck to be listed, got %d decks", len(page.Decks))
+	}
+	if members, _ := mr.ZMembers(redisIndexKey); len(members) != 1 {
+		t.Errorf("Expected expired deck to be removed from the index, got %v", members)
+	}
+}
+
+// two instances sharing Redis race for the same deck, like replicas behind a
+// load balancer would
+func TestRedisStorageDrawsAreAtomicAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicas := []*RedisStorage{newTestRedisStorage(t, mr), newTestRedisStorage(t, mr)}
+	d := saveDeck(t, replicas[0], true)
+	ctx := context.Background()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		dealt = make(map[string]int)
+	)
+	workers := 60
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(s *RedisStorage) {
+			defer wg.Done()
+			var drawn []deck.Card
+			_, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error {
+				if len(d.Cards) == 0 {
+					return errors.New("deck exhausted")
+				}
+				drawn = d.Draw(1)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, card := range drawn {
+				dealt[card.Code]++
+			}
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+
+	if len(dealt) != 52 {
+		t.Errorf("Expected all 52 cards to be dealt, got %d distinct cards", len(dealt))
+	}
+	for code, n := range dealt {
+		if n != 1 {
+			t.Errorf("Card %s was dealt %d times", code, n)
+		}
+	}
+}
+
+func TestRetryBacksOffUntilContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	calls := 0
+	err := retry(ctx, func() error {
+		calls++
+		return &ConflictError{ID: uuid.New(), Expected: 1, Actual: 2}
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected retry to give up with the context, got %v", err)
+	}
+	// without backoff fn runs as fast as it can, many thousand times
+	if calls < 2 || calls > 50 {
+		t.Errorf("Expected a handful of retries spaced out by backoff, got %d", calls)
+	}
+
+	calls = 0
+	err = retry(context.Background(), func() error {
+		if calls++; calls < 3 {
+			return &ConflictError{}
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected retry to stop once fn succeeds, got %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite" // pure Go driver, so the binary still builds with CGO_ENABLED=0
+
+	"deck-of-cards/deck"
+)
+
+// sqliteMigrations are applied in order on startup and PRAGMA user_version
+// records how many of them were applied. Released migrations must never be
+// changed, append a new one instead
+var sqliteMigrations = []string{
+	`CREATE TABLE decks (
+		id               TEXT PRIMARY KEY,
+		created_at       INTEGER NOT NULL,
+		last_accessed_at INTEGER NOT NULL,
+		ttl              INTEGER NOT NULL,
+		shuffled         INTEGER NOT NULL,
+		remaining        INTEGER NOT NULL,
+		version          INTEGER NOT NULL,
+		data             TEXT NOT NULL
+	);
+	CREATE INDEX decks_created_at ON decks (created_at, id);
+	CREATE TABLE tombstones (
+		id         TEXT PRIMARY KEY,
+		deleted_at INTEGER NOT NULL
+	);`,
+	// tombstones keep the last state of the deck for its history
+	`ALTER TABLE tombstones ADD COLUMN deck TEXT NOT NULL DEFAULT '{}';`,
+	// the histories of decks and tombstones, writes only insert their own events
+	`CREATE TABLE events (
+		deck_id TEXT NOT NULL,
+		idx     INTEGER NOT NULL,
+		data    TEXT NOT NULL,
+		PRIMARY KEY (deck_id, idx)
+	) WITHOUT ROWID;`,
+}
+
+// the deck's own TTL wins over the storage-wide one, like in Settings.Expired
+const (
+	sqliteEffectiveTTL = "(CASE WHEN ttl > 0 THEN ttl ELSE :ttl END)"
+	sqliteExpired      = sqliteEffectiveTTL + " > 0 AND :now - last_accessed_at >= " + sqliteEffectiveTTL
+)
+
+// SQLiteStorage keeps decks in an embedded SQLite database. Besides the deck
+// itself, which is stored as JSON, every row has the columns needed to filter
+// and list decks without decoding them. Events are rows of their own
+type SQLiteStorage struct {
+	settings Settings
+	db       *sql.DB
+}
+
+func NewSQLiteStorage(path string, opts ...Option) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer anyway, a single connection makes
+	// transactions queue up instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStorage{settings: ApplyOptions(opts...), db: db}, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+	for ; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("applying migration %d: %w", version+1, err)
+		}
+		// PRAGMA doesn't support placeholders
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logrus.WithField("version", version+1).Info("Applied storage migration")
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+// inTx runs fn in a transaction, which is rolled back if fn fails. Missing
+// decks are not a failure, so evictions made on lookup are still committed
+func (s *SQLiteStorage) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil && !errors.Is(err, ErrDeckNotFound) {
+		tx.Rollback()
+		return err
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		return commitErr
+	}
+	return err
+}
+
+// like in memory, expired decks are evicted on lookup
+func (s *SQLiteStorage) lookup(ctx context.Context, tx *sql.Tx, id uuid.UUID) (deck.Deck, error) {
+	var data string
+	err := tx.QueryRowContext(ctx, "SELECT data FROM decks WHERE id = ?", id.String()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return deck.Deck{}, s.notFound(ctx, tx, id)
+	}
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	var d deck.Deck
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return deck.Deck{}, fmt.Errorf("decoding deck with id=%v: %w", id, err)
+	}
+	if s.settings.Expired(d) {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM decks WHERE id = ?", id.String()); err != nil {
+			return deck.Deck{}, err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE deck_id = ?", id.String()); err != nil {
+			return deck.Deck{}, err
+		}
+		return deck.Deck{}, s.notFound(ctx, tx, id)
+	}
+	return d, nil
+}
+
+func (s *SQLiteStorage) notFound(ctx context.Context, tx *sql.Tx, id uuid.UUID) error {
+	return notFound(id, s.tombstoned(ctx, tx, id))
+}
+
+// expired tombstones are ignored until they are purged
+func (s *SQLiteStorage) readTombstone(ctx context.Context, tx *sql.Tx, id uuid.UUID) (tombstone, bool) {
+	var (
+		deletedAt int64
+		data      string
+	)
+	err := tx.QueryRowContext(ctx, "SELECT deleted_at, deck FROM tombstones WHERE id = ?", id.String()).Scan(&deletedAt, &data)
+	if err != nil || s.settings.TombstoneExpired(time.Unix(0, deletedAt)) {
+		return tombstone{}, false
+	}
+	t := tombstone{DeletedAt: time.Unix(0, deletedAt).UTC()}
+	if err := json.Unmarshal([]byte(data), &t.Deck); err != nil {
+		logrus.WithError(err).WithField("deck_id", id).Error("Error decoding deleted deck")
+	}
+	return t, true
+}
+
+func (s *SQLiteStorage) tombstoned(ctx context.Context, tx *sql.Tx, id uuid.UUID) bool {
+	_, found := s.readTombstone(ctx, tx, id)
+	return found
+}
+
+func (s *SQLiteStorage) purgeTombstones(ctx context.Context, tx *sql.Tx) error {
+	cutoff := s.settings.Now().Add(-s.settings.TombstoneTTL).UnixNano()
+	_, err := tx.ExecContext(ctx, "DELETE FROM events WHERE deck_id IN (SELECT id FROM tombstones WHERE deleted_at <= ?)", cutoff)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM tombstones WHERE deleted_at <= ?", cutoff)
+	return err
+}
+
+// appendEvents ends the history of d with the events, which were taken off it
+func (s *SQLiteStorage) appendEvents(ctx context.Context, tx *sql.Tx, d deck.Deck, events []deck.Event) error {
+	from := d.RecordedEvents - len(events)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM events WHERE deck_id = ? AND idx >= ?", d.ID.String(), from); err != nil {
+		return err
+	}
+	for i, e := range events {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO events (deck_id, idx, data) VALUES (?, ?, ?)", d.ID.String(), from+i, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) readEvents(ctx context.Context, tx *sql.Tx, id uuid.UUID) ([]deck.Event, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT data FROM events WHERE deck_id = ? ORDER BY idx", id.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []deck.Event
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var e deck.Event
+		if err := json.Unmarshal([]byte(data), &e); err != nil {
+			return nil, fmt.Errorf("decoding event of deck with id=%v: %w", id, err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteStorage) writeDeck(ctx context.Context, tx *sql.Tx, d deck.Deck) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO decks (id, created_at, last_accessed_at, ttl, shuffled, remaining, version, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = excluded.created_at,
+			last_accessed_at = excluded.last_accessed_at,
+			ttl = excluded.ttl,
+			shuffled = excluded.shuffled,
+			remaining = excluded.remaining,
+			version = excluded.version,
+			data = excluded.data`,
+		d.ID.String(), d.CreatedAt.UnixNano(), d.LastAccessedAt.UnixNano(), int64(d.TTL),
+		d.Shuffled, len(d.Cards), d.Version, string(data),
+	)
+	return err
+}
+
+func (s *SQLiteStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tombstones WHERE id = ?", d.ID.String()); err != nil {
+			return err
+		}
+		// the deck brings its whole history, which replaces the stored one
+		d.RecordedEvents = 0
+		if err := s.appendEvents(ctx, tx, d, takeEvents(ctx, &d)); err != nil {
+			return err
+		}
+		return s.writeDeck(ctx, tx, d)
+	})
+}
+
+func (s *SQLiteStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	var d deck.Deck
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if d, err = s.lookup(ctx, tx, id); err != nil {
+			return err
+		}
+		if !s.settings.TouchRead(&d) {
+			return nil
+		}
+		return s.writeDeck(ctx, tx, d)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrDeckNotFound) {
+			logrus.WithError(err).WithField("deck_id", id).Error("Error reading deck")
+		}
+		return deck.Deck{}, false
+	}
+	return d, true
+}
+
+func (s *SQLiteStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		d, err := s.lookup(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		t, events := newTombstone(ctx, d, s.settings.Now())
+		data, err := json.Marshal(t.Deck)
+		if err != nil {
+			return err
+		}
+		if err := s.appendEvents(ctx, tx, t.Deck, events); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM decks WHERE id = ?", id.String()); err != nil {
+			return err
+		}
+		if err := s.purgeTombstones(ctx, tx); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO tombstones (id, deleted_at, deck) VALUES (?, ?, ?)",
+			id.String(), t.DeletedAt.UnixNano(), string(data))
+		return err
+	})
+}
+
+func (s *SQLiteStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	var deleted bool
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		deleted = s.tombstoned(ctx, tx, id)
+		return nil
+	})
+	return err == nil && deleted
+}
+
+func (s *SQLiteStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		stored, err := s.lookup(ctx, tx, d.ID)
+		if err != nil {
+			return err
+		}
+		if stored.Version != d.Version {
+			return &ConflictError{ID: d.ID, Expected: d.Version, Actual: stored.Version}
+		}
+		events := takeEvents(ctx, &d)
+		s.settings.Touch(&d)
+		d.Version++
+		if err := s.appendEvents(ctx, tx, d, events); err != nil {
+			return err
+		}
+		return s.writeDeck(ctx, tx, d)
+	})
+}
+
+// MutateDeck runs fn inside a transaction, so concurrent draws from the same
+// deck are serialized by the database
+func (s *SQLiteStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	var d deck.Deck
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		if d, err = s.lookup(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := fn(&d); err != nil {
+			return err
+		}
+		events := takeEvents(ctx, &d)
+		s.settings.Touch(&d)
+		d.Version++
+		if err := s.appendEvents(ctx, tx, d, events); err != nil {
+			return err
+		}
+		return s.writeDeck(ctx, tx, d)
+	})
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	return d, nil
+}
+
+func (s *SQLiteStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	var d deck.Deck
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		d, err = s.lookup(ctx, tx, id)
+		if errors.Is(err, ErrDeckNotFound) {
+			t, found := s.readTombstone(ctx, tx, id)
+			if !found {
+				return err
+			}
+			d, err = t.Deck, nil
+		}
+		if err != nil {
+			return err
+		}
+		events, err := s.readEvents(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		d = withHistory(d, events)
+		return nil
+	})
+	if err != nil {
+		return deck.Deck{}, err
+	}
+	return d, nil
+}
+
+// List filters and pages decks in SQL using the columns next to the deck data
+func (s *SQLiteStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+	after, err := ParseCursor(cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	conditions := []string{"NOT (" + sqliteExpired + ")"}
+	args := []any{
+		sql.Named("ttl", int64(s.settings.TTL)),
+		sql.Named("now", s.settings.Now().UnixNano()),
+		sql.Named("limit", filter.PageSize()+1),
+	}
+	if cursor != "" {
+		conditions = append(conditions, "(created_at, id) > (:after_created_at, :after_id)")
+		args = append(args, sql.Named("after_created_at", after.CreatedAt.UnixNano()), sql.Named("after_id", after.ID.String()))
+	}
+	if filter.RemainingLessThan != nil {
+		conditions = append(conditions, "remaining < :remaining")
+		args = append(args, sql.Named("remaining", *filter.RemainingLessThan))
+	}
+	if filter.Shuffled != nil {
+		conditions = append(conditions, "shuffled = :shuffled")
+		args = append(args, sql.Named("shuffled", *filter.Shuffled))
+	}
+	if !filter.CreatedAfter.IsZero() {
+		conditions = append(conditions, "created_at > :created_after")
+		args = append(args, sql.Named("created_after", filter.CreatedAfter.UnixNano()))
+	}
+	query := "SELECT data FROM decks WHERE " + strings.Join(conditions, " AND ") + " ORDER BY created_at, id LIMIT :limit"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ListPage{}, err
+	}
+	defer rows.Close()
+
+	var matched []deck.Deck
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return ListPage{}, err
+		}
+		var d deck.Deck
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return ListPage{}, err
+		}
+		matched = append(matched, d)
+	}
+	if err := rows.Err(); err != nil {
+		return ListPage{}, err
+	}
+	return paginate(matched, filter), nil
+}
+
+// EvictExpired deletes decks which were not used for longer than their TTL
+// along with expired tombstones, and returns the number of evicted decks
+func (s *SQLiteStorage) EvictExpired() int {
+	ctx := context.Background()
+	var evicted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		args := []any{sql.Named("ttl", int64(s.settings.TTL)), sql.Named("now", s.settings.Now().UnixNano())}
+		_, err := tx.ExecContext(ctx, "DELETE FROM events WHERE deck_id IN (SELECT id FROM decks WHERE "+sqliteExpired+")", args...)
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, "DELETE FROM decks WHERE "+sqliteExpired, args...)
+		if err != nil {
+			return err
+		}
+		if evicted, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		return s.purgeTombstones(ctx, tx)
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Error evicting expired decks")
+		return 0
+	}
+	return int(evicted)
+}
+
+// RunJanitor evicts expired decks every interval until ctx is cancelled
+func (s *SQLiteStorage) RunJanitor(ctx context.Context, interval time.Duration) {
+	runJanitor(ctx, interval, s.EvictExpired)
+}
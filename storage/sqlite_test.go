@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func newTestSQLiteStorage(t *testing.T, path string, opts ...Option) *SQLiteStorage {
+	t.Helper()
+	s, err := NewSQLiteStorage(path, opts...)
+	if err != nil {
+		t.Fatalf("NewSQLiteStorage failed: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLiteStorageMigratesOnce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decks.db")
+	s := newTestSQLiteStorage(t, path)
+	d := saveDeck(t, s, true)
+	s.Close()
+
+	// opening the database again must not try to apply the migrations twice
+	reopened := newTestSQLiteStorage(t, path)
+	var version int
+	if err := reopened.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatalf("Error reading schema version: %s", err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("Expected schema version %d, got %d", len(sqliteMigrations), version)
+	}
+	if _, found := reopened.GetDeck(context.Background(), d.ID); !found {
+		t.Errorf("Deck was lost on restart")
+	}
+}
+
+func TestSQLiteStorageRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decks.db")
+	s := newTestSQLiteStorage(t, path)
+	if _, err := s.db.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatalf("Error bumping schema version: %s", err)
+	}
+	s.Close()
+
+	if _, err := NewSQLiteStorage(path); err == nil {
+		t.Errorf("Expected error opening database with a newer schema")
+	}
+}
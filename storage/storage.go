@@ -2,63 +2,490 @@ package storage
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
 
 	"deck-of-cards/deck"
 )
 
+const (
+	DefaultTombstoneTTL = 10 * time.Minute
+	// DefaultShards is the number of shards InMemoryStorage splits decks into
+	DefaultShards = 64
+)
+
+var (
+	ErrDeckNotFound = errors.New("deck not found")
+	// ErrDeckGone is returned for recently deleted decks, it always comes
+	// wrapped together with ErrDeckNotFound
+	ErrDeckGone = errors.New("deck was deleted")
+)
+
+// ConflictError is returned when a write is based on a stale version of the deck
+type ConflictError struct {
+	ID       uuid.UUID
+	Expected int64
+	Actual   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("deck with id=%v was modified concurrently: writing over version %d, stored version is %d", e.ID, e.Expected, e.Actual)
+}
+
+// MutateFunc changes the deck in place. Returning an error aborts the
+// mutation and leaves the stored deck untouched. Storage may call it more than
+// once when the deck changes under it, so it should only touch the deck and
+// its own results.
+type MutateFunc func(d *deck.Deck) error
+
+// DeckStorage keeps decks. Methods returning an error fail with ctx.Err()
+// without changing anything once ctx is done. Implementations are checked
+// with storagetest.RunConformance.
+//
+// The events of a deck are kept apart from it and only ever appended to, so
+// writes don't grow with the history. Only DeckHistory hands them out, the
+// other methods return decks with their events taken, see deck.TakeEvents
 type DeckStorage interface {
+	// SaveDeck stores the deck along with its history, which is all of
+	// d.Events, replacing the deck stored with the same ID
 	SaveDeck(ctx context.Context, d deck.Deck) error
 	GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool)
+	// DeleteDeck removes the deck and leaves a tombstone behind for a while,
+	// so it can be told apart from decks that never existed
 	DeleteDeck(ctx context.Context, id uuid.UUID) error
+	// DeckDeleted reports whether there is a tombstone for the deck
+	DeckDeleted(ctx context.Context, id uuid.UUID) bool
+	// UpdateDeck overwrites the stored deck and bumps its version. It fails
+	// with *ConflictError if d.Version doesn't match the stored version.
 	UpdateDeck(ctx context.Context, d deck.Deck) error
+	// MutateDeck atomically applies fn to the stored deck and returns the
+	// resulting deck with its version bumped, so read-modify-write cycles
+	// like drawing cards can't lose updates when requests race on the same deck.
+	MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error)
+	// List returns a page of decks matching the filter in order of creation,
+	// starting after the cursor. Listing doesn't count as access to the decks
+	List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error)
+	// DeckHistory returns the deck along with its events, or the last state
+	// of a deleted deck while there is a tombstone for it. Reading the history
+	// doesn't count as access to the deck
+	DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error)
+}
+
+// Settings are the options storage is configured with, resolved with their
+// defaults, they are shared by all storage implementations. Storage written
+// outside this package reads its options from them too, see ApplyOptions
+type Settings struct {
+	// TTL is how long decks are kept when not used, zero keeps them forever.
+	// Decks can override it with their own TTL
+	TTL          time.Duration
+	TombstoneTTL time.Duration
+	Now          func() time.Time
+	// Shards is only used by InMemoryStorage
+	Shards int
+}
+
+// Option configures storage
+type Option func(*Settings)
+
+// WithTTL evicts decks which were not used for ttl
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Settings) {
+		s.TTL = ttl
+	}
+}
+
+// WithTombstoneTTL sets how long deleted decks are remembered
+func WithTombstoneTTL(ttl time.Duration) Option {
+	return func(s *Settings) {
+		s.TombstoneTTL = ttl
+	}
+}
+
+// WithClock makes storage read the time from now instead of the system
+// clock, so tests can move it forward
+func WithClock(now func() time.Time) Option {
+	return func(s *Settings) {
+		s.Now = now
+	}
+}
+
+// WithShards splits in-memory decks into n shards with a lock each, so
+// decks in different shards can be used in parallel
+func WithShards(n int) Option {
+	return func(s *Settings) {
+		s.Shards = n
+	}
+}
+
+// ApplyOptions applies the options to the default settings
+func ApplyOptions(opts ...Option) Settings {
+	s := Settings{
+		TombstoneTTL: DefaultTombstoneTTL,
+		Now:          time.Now,
+	}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
 }
 
+// accessResolution is the fraction of its TTL by which the recorded access
+// time of a deck may lag behind reads of it
+const accessResolution = 10
+
+// DeckTTL is how long the deck is kept when not used
+func (s Settings) DeckTTL(d deck.Deck) time.Duration {
+	if d.TTL > 0 {
+		return d.TTL
+	}
+	return s.TTL
+}
+
+// Expired reports whether the deck was not used for its TTL
+func (s Settings) Expired(d deck.Deck) bool {
+	ttl := s.DeckTTL(d)
+	return ttl > 0 && s.Now().Sub(d.LastAccessedAt) >= ttl
+}
+
+// TombstoneExpired reports whether a deck deleted at deletedAt can be
+// forgotten
+func (s Settings) TombstoneExpired(deletedAt time.Time) bool {
+	return s.Now().Sub(deletedAt) >= s.TombstoneTTL
+}
+
+// Touch records an access to the deck
+func (s Settings) Touch(d *deck.Deck) {
+	d.LastAccessedAt = s.Now().UTC().Round(0)
+}
+
+// TouchRead records a read of the deck and reports whether the deck has to
+// be written back. Writing on every read would make reads as costly as
+// writes, so the access time is only moved once it lags by a tenth of the
+// TTL, and decks may expire that much early. Decks kept forever don't need it
+func (s Settings) TouchRead(d *deck.Deck) bool {
+	ttl := s.DeckTTL(*d)
+	if ttl <= 0 || s.Now().Sub(d.LastAccessedAt) < ttl/accessResolution {
+		return false
+	}
+	s.Touch(d)
+	return true
+}
+
+// inMemoryShard holds the decks whose IDs hash to it, operations on decks in
+// different shards never wait for each other
+type inMemoryShard struct {
+	mu         sync.Mutex
+	decks      map[uuid.UUID]deck.Deck
+	tombstones map[uuid.UUID]tombstone
+	// events are the histories of the decks and tombstones
+	events map[uuid.UUID][]deck.Event
+}
+
+// InMemoryStorage keeps decks in maps. Decks are copied on the way in and
+// out, so callers changing their decks never change the stored ones
 type InMemoryStorage struct {
-	decks map[uuid.UUID]deck.Deck
-	mu    sync.Mutex
+	settings Settings
+	shards   []*inMemoryShard
+	// wal is only set for durable storage, see NewDurableInMemoryStorage
+	wal *writeAheadLog
+}
+
+func NewInMemoryStorage(opts ...Option) *InMemoryStorage {
+	s := &InMemoryStorage{settings: ApplyOptions(opts...)}
+	n := s.settings.Shards
+	if n < 1 {
+		n = DefaultShards
+	}
+	s.shards = make([]*inMemoryShard, n)
+	for i := range s.shards {
+		s.shards[i] = &inMemoryShard{
+			decks:      make(map[uuid.UUID]deck.Deck),
+			tombstones: make(map[uuid.UUID]tombstone),
+			events:     make(map[uuid.UUID][]deck.Event),
+		}
+	}
+	return s
+}
+
+// random UUIDs spread evenly over the shards by their last bytes, which are
+// random for time ordered UUIDs too
+func (s *InMemoryStorage) shard(id uuid.UUID) *inMemoryShard {
+	return s.shards[binary.BigEndian.Uint32(id[12:])%uint32(len(s.shards))]
 }
 
-func NewInMemoryStorage() *InMemoryStorage {
-	return &InMemoryStorage{
-		decks: make(map[uuid.UUID]deck.Deck),
+// lockAll locks every shard in order, for operations that need all decks at once
+func (s *InMemoryStorage) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *InMemoryStorage) unlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Unlock()
+	}
+}
+
+// should be called with the shard lock held. Expired decks are evicted on
+// lookup, so they are never handed out even if the janitor didn't get to them yet
+func (s *InMemoryStorage) lookup(sh *inMemoryShard, id uuid.UUID) (deck.Deck, bool) {
+	d, found := sh.decks[id]
+	if found && s.settings.Expired(d) {
+		delete(sh.decks, id)
+		delete(sh.events, id)
+		return deck.Deck{}, false
+	}
+	return d, found
+}
+
+// should be called with the shard lock held
+func (s *InMemoryStorage) notFound(sh *inMemoryShard, id uuid.UUID) error {
+	return notFound(id, s.tombstoned(sh, id))
+}
+
+func notFound(id uuid.UUID, deleted bool) error {
+	if deleted {
+		return fmt.Errorf("%w: %w: id=%v", ErrDeckNotFound, ErrDeckGone, id)
+	}
+	return fmt.Errorf("%w: id=%v", ErrDeckNotFound, id)
+}
+
+// should be called with the shard lock held, purges the tombstone if it's expired
+func (s *InMemoryStorage) tombstoned(sh *inMemoryShard, id uuid.UUID) bool {
+	t, found := sh.tombstones[id]
+	if found && s.settings.TombstoneExpired(t.DeletedAt) {
+		delete(sh.tombstones, id)
+		delete(sh.events, id)
+		return false
+	}
+	return found
+}
+
+// should be called with the shard lock held
+func (s *InMemoryStorage) purgeTombstones(sh *inMemoryShard) {
+	for id, t := range sh.tombstones {
+		if s.settings.TombstoneExpired(t.DeletedAt) {
+			delete(sh.tombstones, id)
+			delete(sh.events, id)
+		}
 	}
 }
 
 func (s *InMemoryStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh := s.shard(d.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	s.decks[d.ID] = d
+	d = d.Clone()
+	// the deck brings its whole history, which replaces the stored one
+	d.RecordedEvents = 0
+	events := takeEvents(ctx, &d)
+	rec := walRecord{Op: walPut, Deck: &d, Events: events}
+	if err := s.log(rec); err != nil {
+		return err
+	}
+	s.apply(rec)
 	return nil
 }
 
 func (s *InMemoryStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	d, found := s.decks[id]
-	return d, found
+	d, found := s.lookup(sh, id)
+	if !found {
+		return deck.Deck{}, false
+	}
+	if s.settings.TouchRead(&d) {
+		rec := walRecord{Op: walTouch, ID: id, AccessedAt: d.LastAccessedAt}
+		if err := s.log(rec); err != nil {
+			logrus.WithError(err).WithField("deck_id", id).Error("Error recording deck access")
+			return d.Clone(), true
+		}
+		s.apply(rec)
+	}
+	return d.Clone(), true
 }
 
 func (s *InMemoryStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	delete(s.decks, id)
+	d, found := s.lookup(sh, id)
+	if !found {
+		return s.notFound(sh, id)
+	}
+	t, events := newTombstone(ctx, d, s.settings.Now())
+	rec := walRecord{Op: walDelete, ID: id, DeletedAt: t.DeletedAt, Deck: &t.Deck, Events: events}
+	if err := s.log(rec); err != nil {
+		return err
+	}
+	s.purgeTombstones(sh)
+	s.apply(rec)
 	return nil
 }
 
+func (s *InMemoryStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	return s.tombstoned(sh, id)
+}
+
 func (s *InMemoryStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sh := s.shard(d.ID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
 
-	if _, found := s.decks[d.ID]; !found {
-		return fmt.Errorf("deck with id=%v not found", d.ID)
+	stored, found := s.lookup(sh, d.ID)
+	if !found {
+		return s.notFound(sh, d.ID)
+	}
+	if stored.Version != d.Version {
+		return &ConflictError{ID: d.ID, Expected: d.Version, Actual: stored.Version}
+	}
+	d = d.Clone()
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	rec := walRecord{Op: walPut, Deck: &d, Events: events}
+	if err := s.log(rec); err != nil {
+		return err
 	}
-	s.decks[d.ID] = d
+	s.apply(rec)
 	return nil
 }
+
+func (s *InMemoryStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn MutateFunc) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	d, found := s.lookup(sh, id)
+	if !found {
+		return deck.Deck{}, s.notFound(sh, id)
+	}
+	// fn may change the cards in place, like shuffling does, so it gets a
+	// copy which is only stored if it succeeds
+	d = d.Clone()
+	if err := fn(&d); err != nil {
+		return deck.Deck{}, err
+	}
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	rec := walRecord{Op: walPut, Deck: &d, Events: events}
+	if err := s.log(rec); err != nil {
+		return deck.Deck{}, err
+	}
+	s.apply(rec)
+	return d.Clone(), nil
+}
+
+// List goes through the shards one at a time, so it doesn't stop the other
+// shards while it runs. Decks saved meanwhile may or may not be listed
+func (s *InMemoryStorage) List(ctx context.Context, filter ListFilter, cursor string) (ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return ListPage{}, err
+	}
+	after, err := ParseCursor(cursor)
+	if err != nil {
+		return ListPage{}, err
+	}
+
+	var matched []deck.Deck
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for _, d := range sh.decks {
+			if !s.settings.Expired(d) && filter.Match(d) && after.Less(CursorOf(d)) {
+				matched = append(matched, d)
+			}
+		}
+		sh.mu.Unlock()
+	}
+
+	page := paginate(matched, filter)
+	for i, d := range page.Decks {
+		page.Decks[i] = d.Clone()
+	}
+	return page, nil
+}
+
+func (s *InMemoryStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	sh := s.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if d, found := s.lookup(sh, id); found {
+		return withHistory(d, sh.events[id]).Clone(), nil
+	}
+	if s.tombstoned(sh, id) {
+		return withHistory(sh.tombstones[id].Deck, sh.events[id]).Clone(), nil
+	}
+	return deck.Deck{}, s.notFound(sh, id)
+}
+
+// EvictExpired removes decks which were not used for longer than their TTL
+// along with expired tombstones, and returns the number of evicted decks
+func (s *InMemoryStorage) EvictExpired() int {
+	evicted := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for id, d := range sh.decks {
+			if s.settings.Expired(d) {
+				delete(sh.decks, id)
+				delete(sh.events, id)
+				evicted++
+			}
+		}
+		s.purgeTombstones(sh)
+		sh.mu.Unlock()
+	}
+	return evicted
+}
+
+// RunJanitor evicts expired decks every interval until ctx is cancelled
+func (s *InMemoryStorage) RunJanitor(ctx context.Context, interval time.Duration) {
+	runJanitor(ctx, interval, s.EvictExpired)
+}
+
+func runJanitor(ctx context.Context, interval time.Duration, evict func() int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Storage janitor stopped")
+			return
+		case <-ticker.C:
+			if evicted := evict(); evicted > 0 {
+				logrus.WithField("evicted", evicted).Info("Evicted expired decks")
+			}
+		}
+	}
+}
@@ -2,97 +2,101 @@ package storage
 
 import (
 	"context"
-	"reflect"
+	"fmt"
+	"math/rand"
 	"sync"
-
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 
 	"deck-of-cards/deck"
 )
 
-func TestNewInMemoryStorage(t *testing.T) {
-	st := NewInMemoryStorage()
-
-	var wg sync.WaitGroup
-
-	count := 10
-	wg.Add(count)
-
-	for i := 0; i < count; i++ {
-		ctx := context.Background()
-		go func() {
-			d := deck.NewDeck(uuid.New(), false, nil)
-			if err := st.SaveDeck(ctx, *d); err != nil {
-				t.Errorf("Error saving deck")
-			}
-
-			wg.Done()
-		}()
-	}
-
-	wg.Wait()
-}
-
-func TestSaveAndGetDeck(t *testing.T) {
-	s := NewInMemoryStorage()
-	id := uuid.New()
-	d := deck.NewDeck(id, false, nil)
-	ctx := context.Background()
-	err := s.SaveDeck(ctx, *d)
-	if err != nil {
-		t.Errorf("SaveDeck failed: %s", err)
-	}
-	dd, found := s.GetDeck(ctx, id)
-	if !found {
-		t.Errorf("Deck was not found after creation")
+func TestRunJanitorStopsWithContext(t *testing.T) {
+	s := NewInMemoryStorage(WithTTL(time.Nanosecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	d := deck.NewDeck(uuid.New(), false, nil)
+	_ = s.SaveDeck(ctx, *d)
+	sh := s.shard(d.ID)
+
+	done := make(chan struct{})
+	go func() {
+		s.RunJanitor(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		sh.mu.Lock()
+		remaining := len(sh.decks)
+		sh.mu.Unlock()
+		if remaining == 0 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("Janitor did not evict the expired deck")
+		case <-time.After(time.Millisecond):
+		}
 	}
 
-	// I would use probably some external package to make it look less
-	if !reflect.DeepEqual(d, &dd) {
-		t.Errorf("Saved deck and retrieved deck are not the same")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Janitor did not stop after context was cancelled")
 	}
 }
 
-// I don't use this method in service but I have it in the deck, so better test it, eh?
-func TestDeleteDeck(t *testing.T) {
-	s := NewInMemoryStorage()
-	id := uuid.New()
-	d := deck.NewDeck(id, false, nil)
-	ctx := context.Background()
-	if err := s.SaveDeck(ctx, *d); err != nil {
-		t.Errorf("Error saving deck")
-	}
-	if err := s.DeleteDeck(ctx, d.ID); err != nil {
-		t.Errorf("Error deleting deck")
-	}
-	_, found := s.GetDeck(ctx, d.ID)
-	if found {
-		t.Errorf("Deck was found after deletion")
+// a single shard is the same as locking all decks behind one mutex, which is
+// how InMemoryStorage worked before sharding
+func BenchmarkInMemoryStorage(b *testing.B) {
+	for _, shards := range []int{1, DefaultShards} {
+		for _, goroutines := range []int{1, 8, 64} {
+			b.Run(fmt.Sprintf("Shards=%d/Goroutines=%d", shards, goroutines), func(b *testing.B) {
+				benchmarkStorage(b, NewInMemoryStorage(WithShards(shards)), goroutines)
+			})
+		}
 	}
 }
 
-func TestUpdateDeck(t *testing.T) {
-	s := NewInMemoryStorage()
-	id := uuid.New()
-
-	d := deck.NewDeck(id, false, nil)
+// benchmarkStorage spreads b.N operations over the goroutines, three reads
+// for every write, each on a random deck
+func benchmarkStorage(b *testing.B, s DeckStorage, goroutines int) {
 	ctx := context.Background()
-	_ = s.SaveDeck(ctx, *d)
-
-	d.Shuffle()
-	err := s.UpdateDeck(ctx, *d)
-	if err != nil {
-		t.Errorf("UpdateDeck failed: %s", err)
-	}
-
-	dd, found := s.GetDeck(ctx, d.ID)
-	if !found {
-		t.Errorf("Somehow, updated deck not found")
+	ids := make([]uuid.UUID, 1024)
+	for i := range ids {
+		d := deck.NewDeck(uuid.New(), false, nil)
+		if err := s.SaveDeck(ctx, *d); err != nil {
+			b.Fatalf("SaveDeck failed: %s", err)
+		}
+		ids[i] = d.ID
 	}
 
-	if !reflect.DeepEqual(d, &dd) {
-		t.Errorf("Updated deck does not match")
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	for g := 0; g < goroutines; g++ {
+		ops := b.N / goroutines
+		if g < b.N%goroutines {
+			ops++
+		}
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for i := 0; i < ops; i++ {
+				id := ids[r.Intn(len(ids))]
+				if i%4 != 0 {
+					s.GetDeck(ctx, id)
+					continue
+				}
+				if _, err := s.MutateDeck(ctx, id, func(d *deck.Deck) error { return nil }); err != nil {
+					b.Errorf("MutateDeck failed: %s", err)
+					return
+				}
+			}
+		}(int64(g))
 	}
+	wg.Wait()
 }
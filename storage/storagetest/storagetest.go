@@ -0,0 +1,825 @@
+// Package storagetest checks implementations of storage.DeckStorage against
+// the contract every storage has to keep. Backends run RunConformance from
+// their tests, see the ones in the storage package
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+	"deck-of-cards/storage"
+)
+
+// Storage is what every storage implementation provides
+type Storage interface {
+	storage.DeckStorage
+	// EvictExpired removes decks which were not used for longer than their
+	// TTL along with expired tombstones, and returns the number of evicted decks
+	EvictExpired() int
+}
+
+// Factory returns new empty storage for every test, configured with the
+// options. Storage must honour storage.WithTTL, storage.WithTombstoneTTL and
+// storage.WithClock, which the tests use to move time forward. Storage
+// outside the storage package reads them with storage.ApplyOptions
+type Factory func(t *testing.T, opts ...storage.Option) Storage
+
+// RunConformance runs the tests every storage implementation has to pass,
+// each one in a subtest with storage of its own
+func RunConformance(t *testing.T, newStorage Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newStorage Factory)
+	}{
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"SaveAndGetDeck", testSaveAndGetDeck},
+		{"DeleteDeck", testDeleteDeck},
+		{"UpdateDeck", testUpdateDeck},
+		{"UpdateDeckRejectsStaleVersion", testUpdateDeckRejectsStaleVersion},
+		{"MutateDeckNotFound", testMutateDeckNotFound},
+		{"MutateDeckAbortLeavesDeckUntouched", testMutateDeckAbortLeavesDeckUntouched},
+		{"MutateDeckConcurrentDrawsDealEveryCardOnce", testMutateDeckConcurrentDrawsDealEveryCardOnce},
+		{"DeleteDeckLeavesTombstone", testDeleteDeckLeavesTombstone},
+		{"ExpiredDecksAreEvicted", testExpiredDecksAreEvicted},
+		{"ReadsRecordAccessCoarsely", testReadsRecordAccessCoarsely},
+		{"ListPaginatesInCreationOrder", testListPaginatesInCreationOrder},
+		{"SavingOverDeckListsItOnce", testSavingOverDeckListsItOnce},
+		{"DeckHistory", testDeckHistory},
+		{"EventsAreKeptApart", testEventsAreKeptApart},
+		{"ChangingReturnedDecksLeavesStorageUntouched", testChangingReturnedDecksLeavesStorageUntouched},
+		{"UnknownDeckIsNotFound", testUnknownDeckIsNotFound},
+		{"ConcurrentUpdatesConflict", testConcurrentUpdatesConflict},
+		{"CancelledContextLeavesStorageUntouched", testCancelledContextLeavesStorageUntouched},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newStorage)
+		})
+	}
+}
+
+func testConcurrentSaves(t *testing.T, newStorage Factory) {
+	st := newStorage(t)
+
+	var wg sync.WaitGroup
+
+	count := 10
+	wg.Add(count)
+
+	for i := 0; i < count; i++ {
+		ctx := context.Background()
+		go func() {
+			d := deck.NewDeck(uuid.New(), false, nil)
+			if err := st.SaveDeck(ctx, *d); err != nil {
+				t.Errorf("Error saving deck")
+			}
+
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func testSaveAndGetDeck(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	id := uuid.New()
+	d := deck.NewDeck(id, false, nil)
+	ctx := context.Background()
+	err := s.SaveDeck(ctx, *d)
+	if err != nil {
+		t.Errorf("SaveDeck failed: %s", err)
+	}
+	dd, found := s.GetDeck(ctx, id)
+	if !found {
+		t.Errorf("Deck was not found after creation")
+	}
+
+	// storage may record the access to the deck, and keeps its events apart
+	d.LastAccessedAt = dd.LastAccessedAt
+	d.TakeEvents()
+	// I would use probably some external package to make it look less
+	if !reflect.DeepEqual(d, &dd) {
+		t.Errorf("Saved deck and retrieved deck are not the same")
+	}
+}
+
+// I don't use this method in service but I have it in the deck, so better test it, eh?
+func testDeleteDeck(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	id := uuid.New()
+	d := deck.NewDeck(id, false, nil)
+	ctx := context.Background()
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Errorf("Error saving deck")
+	}
+	if err := s.DeleteDeck(ctx, d.ID); err != nil {
+		t.Errorf("Error deleting deck")
+	}
+	_, found := s.GetDeck(ctx, d.ID)
+	if found {
+		t.Errorf("Deck was found after deletion")
+	}
+}
+
+func testUpdateDeck(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	id := uuid.New()
+
+	d := deck.NewDeck(id, false, nil)
+	ctx := context.Background()
+	_ = s.SaveDeck(ctx, *d)
+
+	d.Shuffle()
+	err := s.UpdateDeck(ctx, *d)
+	if err != nil {
+		t.Errorf("UpdateDeck failed: %s", err)
+	}
+
+	dd, found := s.GetDeck(ctx, d.ID)
+	if !found {
+		t.Errorf("Somehow, updated deck not found")
+	}
+
+	// storage bumps the version on every write and may record the access
+	d.Version++
+	d.LastAccessedAt = dd.LastAccessedAt
+	d.TakeEvents()
+	if !reflect.DeepEqual(d, &dd) {
+		t.Errorf("Updated deck does not match")
+	}
+}
+
+func testUpdateDeckRejectsStaleVersion(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	d := deck.NewDeck(uuid.New(), false, nil)
+	ctx := context.Background()
+	_ = s.SaveDeck(ctx, *d)
+
+	stale := *d
+	if err := s.UpdateDeck(ctx, *d); err != nil {
+		t.Fatalf("UpdateDeck failed: %s", err)
+	}
+
+	var conflict *storage.ConflictError
+	err := s.UpdateDeck(ctx, stale)
+	if !errors.As(err, &conflict) {
+		t.Fatalf("Expected storage.ConflictError on stale write, got %v", err)
+	}
+	if conflict.Expected != stale.Version || conflict.Actual != stale.Version+1 {
+		t.Errorf("Unexpected versions in conflict: %+v", conflict)
+	}
+}
+
+func testMutateDeckNotFound(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	_, err := s.MutateDeck(context.Background(), uuid.New(), func(d *deck.Deck) error {
+		t.Errorf("MutateDeck called fn for a missing deck")
+		return nil
+	})
+	if !errors.Is(err, storage.ErrDeckNotFound) {
+		t.Errorf("Expected storage.ErrDeckNotFound, got %v", err)
+	}
+}
+
+func testMutateDeckAbortLeavesDeckUntouched(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	d := deck.NewDeck(uuid.New(), false, nil)
+	ctx := context.Background()
+	_ = s.SaveDeck(ctx, *d)
+
+	abort := errors.New("abort")
+	_, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error {
+		d.Draw(10)
+		return abort
+	})
+	if !errors.Is(err, abort) {
+		t.Errorf("Expected mutation error to be returned, got %v", err)
+	}
+
+	dd, _ := s.GetDeck(ctx, d.ID)
+	if len(dd.Cards) != 52 {
+		t.Errorf("Aborted mutation changed the stored deck, got %d cards", len(dd.Cards))
+	}
+}
+
+// every goroutine tries to draw a single card, so more goroutines than cards
+// means some of them must come back empty-handed and no card is dealt twice
+func testMutateDeckConcurrentDrawsDealEveryCardOnce(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	d := deck.NewDeck(uuid.New(), true, nil)
+	ctx := context.Background()
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("Error saving deck: %s", err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		dealt = make(map[string]int)
+	)
+	workers := 500
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			var drawn []deck.Card
+			_, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error {
+				if len(d.Cards) == 0 {
+					return errors.New("deck exhausted")
+				}
+				drawn = d.Draw(1)
+				return nil
+			})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, card := range drawn {
+				dealt[card.Code]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(dealt) != 52 {
+		t.Errorf("Expected all 52 cards to be dealt, got %d distinct cards", len(dealt))
+	}
+	for code, n := range dealt {
+		if n != 1 {
+			t.Errorf("Card %s was dealt %d times", code, n)
+		}
+	}
+
+	dd, _ := s.GetDeck(ctx, d.ID)
+	if len(dd.Cards) != 0 {
+		t.Errorf("Expected deck to be exhausted, %d cards remaining", len(dd.Cards))
+	}
+}
+
+func testDeleteDeckLeavesTombstone(t *testing.T, newStorage Factory) {
+	now := time.Now()
+	s := newStorage(t, storage.WithTombstoneTTL(time.Minute), storage.WithClock(func() time.Time { return now }))
+
+	d := deck.NewDeck(uuid.New(), false, nil)
+	ctx := context.Background()
+	_ = s.SaveDeck(ctx, *d)
+
+	if err := s.DeleteDeck(ctx, uuid.New()); !errors.Is(err, storage.ErrDeckNotFound) || errors.Is(err, storage.ErrDeckGone) {
+		t.Errorf("Expected plain storage.ErrDeckNotFound deleting unknown deck, got %v", err)
+	}
+	if err := s.DeleteDeck(ctx, d.ID); err != nil {
+		t.Fatalf("DeleteDeck failed: %s", err)
+	}
+
+	if !s.DeckDeleted(ctx, d.ID) {
+		t.Errorf("Expected tombstone for deleted deck")
+	}
+	if err := s.DeleteDeck(ctx, d.ID); !errors.Is(err, storage.ErrDeckGone) {
+		t.Errorf("Expected storage.ErrDeckGone deleting deck twice, got %v", err)
+	}
+	_, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error { return nil })
+	if !errors.Is(err, storage.ErrDeckGone) || !errors.Is(err, storage.ErrDeckNotFound) {
+		t.Errorf("Expected storage.ErrDeckGone wrapped with storage.ErrDeckNotFound, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if s.DeckDeleted(ctx, d.ID) {
+		t.Errorf("Expected tombstone to be purged after its TTL")
+	}
+	if err := s.UpdateDeck(ctx, *d); errors.Is(err, storage.ErrDeckGone) {
+		t.Errorf("Expected plain storage.ErrDeckNotFound after tombstone expired, got %v", err)
+	}
+}
+
+func testExpiredDecksAreEvicted(t *testing.T, newStorage Factory) {
+	now := time.Now()
+	s := newStorage(t, storage.WithTTL(time.Hour), storage.WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+
+	stale := deck.NewDeck(uuid.New(), false, nil)
+	stale.LastAccessedAt = now
+	short := deck.NewDeck(uuid.New(), false, nil, deck.WithTTL(time.Minute))
+	short.LastAccessedAt = now
+	for _, d := range []*deck.Deck{stale, short} {
+		_ = s.SaveDeck(ctx, *d)
+	}
+
+	now = now.Add(30 * time.Minute)
+	if _, found := s.GetDeck(ctx, short.ID); found {
+		t.Errorf("Deck with its own TTL was not evicted on lookup")
+	}
+	if _, found := s.GetDeck(ctx, stale.ID); !found {
+		t.Fatalf("Deck was evicted before storage TTL")
+	}
+
+	// the lookup above refreshed the deck, so it survives another 59 minutes
+	now = now.Add(59 * time.Minute)
+	if evicted := s.EvictExpired(); evicted != 0 {
+		t.Errorf("Expected nothing to be evicted, evicted %d decks", evicted)
+	}
+	now = now.Add(time.Minute)
+	if evicted := s.EvictExpired(); evicted != 1 {
+		t.Errorf("Expected 1 deck to be evicted, evicted %d", evicted)
+	}
+	// reads agree with writes, caches in front of the storage included. The
+	// read goes first, a failed write may drop the deck from a cache
+	if _, found := s.GetDeck(ctx, stale.ID); found {
+		t.Errorf("Expected evicted deck to be not found by GetDeck")
+	}
+	if _, err := s.MutateDeck(ctx, stale.ID, func(d *deck.Deck) error { return nil }); !errors.Is(err, storage.ErrDeckNotFound) {
+		t.Errorf("Expected evicted deck to be not found, got %v", err)
+	}
+}
+
+// reads only write the access time back once it lags by a tenth of the TTL,
+// so most of them don't cost a write
+func testReadsRecordAccessCoarsely(t *testing.T, newStorage Factory) {
+	now := time.Now().UTC().Round(0)
+	s := newStorage(t, storage.WithTTL(time.Hour), storage.WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+
+	recent := deck.NewDeck(uuid.New(), false, nil)
+	stale := deck.NewDeck(uuid.New(), false, nil)
+	for _, d := range []*deck.Deck{recent, stale} {
+		d.LastAccessedAt = now
+		_ = s.SaveDeck(ctx, *d)
+	}
+
+	now = now.Add(5 * time.Minute)
+	if _, found := s.GetDeck(ctx, recent.ID); !found {
+		t.Fatalf("Deck not found")
+	}
+	now = now.Add(time.Minute)
+	if _, found := s.GetDeck(ctx, stale.ID); !found {
+		t.Fatalf("Deck not found")
+	}
+
+	if d, _ := s.DeckHistory(ctx, recent.ID); !d.LastAccessedAt.Equal(recent.LastAccessedAt) {
+		t.Errorf("Expected read within a tenth of the TTL not to be recorded, access time moved to %v", d.LastAccessedAt)
+	}
+	if d, _ := s.DeckHistory(ctx, stale.ID); !d.LastAccessedAt.Equal(now) {
+		t.Errorf("Expected read after a tenth of the TTL to be recorded at %v, got %v", now, d.LastAccessedAt)
+	}
+}
+
+func testDeckHistory(t *testing.T, newStorage Factory) {
+	now := time.Now()
+	s := newStorage(t, storage.WithTombstoneTTL(time.Minute), storage.WithClock(func() time.Time { return now }))
+	ctx := context.Background()
+
+	d := deck.NewDeck(uuid.New(), false, nil)
+	if err := s.SaveDeck(storage.WithActor(ctx, "alice"), *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	_, err := s.MutateDeck(storage.WithActor(ctx, "bob"), d.ID, func(d *deck.Deck) error {
+		d.Draw(2)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	if err := s.DeleteDeck(storage.WithActor(ctx, "carol"), d.ID); err != nil {
+		t.Fatalf("DeleteDeck failed: %s", err)
+	}
+
+	// history outlives the deck as long as its tombstone
+	h, err := s.DeckHistory(ctx, d.ID)
+	if err != nil {
+		t.Fatalf("DeckHistory failed: %s", err)
+	}
+	expected := []struct {
+		typ   deck.EventType
+		actor string
+	}{
+		{deck.EventCreated, "alice"},
+		{deck.EventDrawn, "bob"},
+		{deck.EventDeleted, "carol"},
+	}
+	if len(h.Events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(h.Events))
+	}
+	for i, e := range expected {
+		if h.Events[i].Type != e.typ || h.Events[i].Actor != e.actor {
+			t.Errorf("Expected event %d to be %s by %s, got %s by %s", i, e.typ, e.actor, h.Events[i].Type, h.Events[i].Actor)
+		}
+	}
+	if drawn, err := h.AtEvent(1); err != nil || len(drawn.Cards) != 50 {
+		t.Errorf("Expected 50 cards after the draw, got %d (%v)", len(drawn.Cards), err)
+	}
+
+	now = now.Add(time.Minute)
+	if _, err := s.DeckHistory(ctx, d.ID); !errors.Is(err, storage.ErrDeckNotFound) {
+		t.Errorf("Expected storage.ErrDeckNotFound after tombstone expired, got %v", err)
+	}
+}
+
+// decks are handed out without their events, which only DeckHistory loads,
+// and every write appends the events it recorded to the history
+func testEventsAreKeptApart(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	ctx := context.Background()
+	d := deck.NewDeck(uuid.New(), false, nil)
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	mutated, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error {
+		d.Draw(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	got, _ := s.GetDeck(ctx, d.ID)
+	update := got.Clone()
+	update.Draw(2)
+	if err := s.UpdateDeck(ctx, update); err != nil {
+		t.Fatalf("UpdateDeck failed: %s", err)
+	}
+	page, err := s.List(ctx, storage.ListFilter{}, "")
+	if err != nil || len(page.Decks) != 1 {
+		t.Fatalf("Expected List to return the deck, got %d decks (%v)", len(page.Decks), err)
+	}
+
+	for _, c := range []struct {
+		method   string
+		deck     deck.Deck
+		recorded int
+	}{
+		{"MutateDeck", mutated, 2},
+		{"GetDeck", got, 2},
+		{"List", page.Decks[0], 3},
+	} {
+		if len(c.deck.Events) != 0 || c.deck.RecordedEvents != c.recorded {
+			t.Errorf("Expected %s to return the deck with %d recorded events and none on it, got %d and %d",
+				c.method, c.recorded, c.deck.RecordedEvents, len(c.deck.Events))
+		}
+	}
+
+	h, err := s.DeckHistory(ctx, d.ID)
+	if err != nil {
+		t.Fatalf("DeckHistory failed: %s", err)
+	}
+	expected := []deck.EventType{deck.EventCreated, deck.EventDrawn, deck.EventDrawn}
+	if len(h.Events) != len(expected) || h.RecordedEvents != 0 {
+		t.Fatalf("Expected history with %d events, got %d and %d left in storage", len(expected), len(h.Events), h.RecordedEvents)
+	}
+	for i, e := range h.Events {
+		if e.Index != i || e.Type != expected[i] {
+			t.Errorf("Expected event %d to be %s, got %s with index %d", i, expected[i], e.Type, e.Index)
+		}
+	}
+
+	// saving a deck over another replaces its history
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	if h, _ := s.DeckHistory(ctx, d.ID); len(h.Events) != 1 {
+		t.Errorf("Expected the history of the saved deck only, got %d events", len(h.Events))
+	}
+}
+
+// scribble changes the deck in every way a caller could, in place
+func scribble(d *deck.Deck) {
+	d.Cards[0] = deck.Card{Value: "JOKER", Suit: "RED", Code: "X2"}
+	d.Drawn = append(d.Drawn[:0], deck.Card{Value: "JOKER", Suit: "BLACK", Code: "X1"})
+	for name := range d.Piles {
+		d.Piles[name][0].Code = "X1"
+	}
+	if len(d.Events) > 0 {
+		d.Events[0].Actor = "mallory"
+		d.Events[0].Order[0] = "X1"
+	}
+}
+
+func testChangingReturnedDecksLeavesStorageUntouched(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	ctx := context.Background()
+	d := deck.NewDeck(uuid.New(), false, nil)
+	d.Draw(1)
+	if err := d.MoveToPile("hand", []string{d.Cards[0].Code}); err != nil {
+		t.Fatalf("MoveToPile failed: %s", err)
+	}
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	want, _ := s.DeckHistory(ctx, d.ID)
+
+	// the check compares with a copy, so it survives scribbling on want itself
+	want = want.Clone()
+	check := func(step string) {
+		t.Helper()
+		got, _ := s.DeckHistory(ctx, d.ID)
+		if !reflect.DeepEqual(stateOf(got), stateOf(want)) {
+			t.Errorf("Changing the deck %s changed the stored deck", step)
+		}
+	}
+
+	scribble(d)
+	check("passed to SaveDeck")
+
+	got, _ := s.GetDeck(ctx, d.ID)
+	scribble(&got)
+	check("returned by GetDeck")
+
+	page, err := s.List(ctx, storage.ListFilter{}, "")
+	if err != nil || len(page.Decks) != 1 {
+		t.Fatalf("Expected List to return the deck, got %d decks (%v)", len(page.Decks), err)
+	}
+	scribble(&page.Decks[0])
+	check("returned by List")
+
+	history, _ := s.DeckHistory(ctx, d.ID)
+	scribble(&history)
+	check("returned by DeckHistory")
+
+	mutated, err := s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error { return nil })
+	if err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	scribble(&mutated)
+	check("returned by MutateDeck")
+
+	// shuffling works on the cards in place, an aborted shuffle must not show
+	_, err = s.MutateDeck(ctx, d.ID, func(d *deck.Deck) error {
+		d.Shuffle()
+		scribble(d)
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("Expected aborted mutation to fail")
+	}
+	check("in an aborted MutateDeck")
+
+	updated, _ := s.GetDeck(ctx, d.ID)
+	if err := s.UpdateDeck(ctx, updated); err != nil {
+		t.Fatalf("UpdateDeck failed: %s", err)
+	}
+	scribble(&updated)
+	check("passed to UpdateDeck")
+}
+
+// deckState keeps what callers can change in place, leaving out what storage
+// changes on every access
+type deckState struct {
+	Cards  []deck.Card
+	Drawn  []deck.Card
+	Piles  map[string][]deck.Card
+	Events []deck.EventType
+	Actors []string
+	Order  []string
+}
+
+func stateOf(d deck.Deck) deckState {
+	s := deckState{Cards: d.Cards, Drawn: d.Drawn, Piles: d.Piles}
+	for _, e := range d.Events {
+		s.Events = append(s.Events, e.Type)
+		s.Actors = append(s.Actors, e.Actor)
+	}
+	if len(d.Events) > 0 {
+		s.Order = d.Events[0].Order
+	}
+	return s
+}
+
+func testListPaginatesInCreationOrder(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	ctx := context.Background()
+	created := time.Now().UTC().Round(0)
+
+	var ids []uuid.UUID
+	for i := 0; i < 5; i++ {
+		d := deck.NewDeck(uuid.New(), i%2 == 0, nil)
+		d.CreatedAt = created.Add(time.Duration(i) * time.Second)
+		d.Cards = d.Cards[:10*i]
+		_ = s.SaveDeck(ctx, *d)
+		ids = append(ids, d.ID)
+	}
+
+	var listed []uuid.UUID
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(ids) {
+			t.Fatalf("Listing didn't stop after %d pages", pages)
+		}
+		page, err := s.List(ctx, storage.ListFilter{Limit: 2}, cursor)
+		if err != nil {
+			t.Fatalf("List failed: %s", err)
+		}
+		for _, d := range page.Decks {
+			listed = append(listed, d.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(listed) != len(ids) {
+		t.Fatalf("Expected %d decks, listed %d", len(ids), len(listed))
+	}
+	for i := range ids {
+		if listed[i] != ids[i] {
+			t.Errorf("Expected deck %v at position %d, got %v", ids[i], i, listed[i])
+		}
+	}
+
+	shuffled := true
+	remaining := 25
+	tests := []struct {
+		name     string
+		filter   storage.ListFilter
+		expected []uuid.UUID
+	}{
+		{"Shuffled", storage.ListFilter{Shuffled: &shuffled}, []uuid.UUID{ids[0], ids[2], ids[4]}},
+		{"Remaining Less Than", storage.ListFilter{RemainingLessThan: &remaining}, []uuid.UUID{ids[0], ids[1], ids[2]}},
+		{"Created After", storage.ListFilter{CreatedAfter: created.Add(2 * time.Second)}, []uuid.UUID{ids[3], ids[4]}},
+		{"Combined", storage.ListFilter{Shuffled: &shuffled, RemainingLessThan: &remaining}, []uuid.UUID{ids[0], ids[2]}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			page, err := s.List(ctx, tc.filter, "")
+			if err != nil {
+				t.Fatalf("List failed: %s", err)
+			}
+			if len(page.Decks) != len(tc.expected) {
+				t.Fatalf("Expected %d decks, got %d", len(tc.expected), len(page.Decks))
+			}
+			for i, d := range page.Decks {
+				if d.ID != tc.expected[i] {
+					t.Errorf("Expected deck %v at position %d, got %v", tc.expected[i], i, d.ID)
+				}
+			}
+		})
+	}
+}
+
+// imports save decks over the stored ones, which may have been created at
+// another time
+func testSavingOverDeckListsItOnce(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	ctx := context.Background()
+	d := deck.NewDeck(uuid.New(), false, nil)
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	d.CreatedAt = d.CreatedAt.Add(-time.Hour)
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+
+	page, err := s.List(ctx, storage.ListFilter{}, "")
+	if err != nil {
+		t.Fatalf("List failed: %s", err)
+	}
+	if len(page.Decks) != 1 {
+		t.Fatalf("Expected the deck to be listed once, got %d decks", len(page.Decks))
+	}
+	if !page.Decks[0].CreatedAt.Equal(d.CreatedAt) {
+		t.Errorf("Expected the deck created at %v, got %v", d.CreatedAt, page.Decks[0].CreatedAt)
+	}
+}
+
+func testUnknownDeckIsNotFound(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	ctx := context.Background()
+	unknown := deck.NewDeck(uuid.New(), false, nil)
+
+	if _, found := s.GetDeck(ctx, unknown.ID); found {
+		t.Errorf("Expected GetDeck not to find unknown deck")
+	}
+	if s.DeckDeleted(ctx, unknown.ID) {
+		t.Errorf("Expected DeckDeleted to be false for unknown deck")
+	}
+	_, mutateErr := s.MutateDeck(ctx, unknown.ID, func(d *deck.Deck) error { return nil })
+	_, historyErr := s.DeckHistory(ctx, unknown.ID)
+	for method, err := range map[string]error{
+		"DeleteDeck":  s.DeleteDeck(ctx, unknown.ID),
+		"UpdateDeck":  s.UpdateDeck(ctx, *unknown),
+		"MutateDeck":  mutateErr,
+		"DeckHistory": historyErr,
+	} {
+		if !errors.Is(err, storage.ErrDeckNotFound) || errors.Is(err, storage.ErrDeckGone) {
+			t.Errorf("Expected plain ErrDeckNotFound from %s, got %v", method, err)
+		}
+	}
+	if _, found := s.GetDeck(ctx, unknown.ID); found {
+		t.Errorf("Expected UpdateDeck not to create unknown deck")
+	}
+}
+
+// writers racing with the same version must not overwrite each other, only
+// one of them wins and the rest get a conflict
+func testConcurrentUpdatesConflict(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	d := deck.NewDeck(uuid.New(), false, nil)
+	ctx := context.Background()
+	if err := s.SaveDeck(ctx, *d); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		succeeded int
+	)
+	writers := 20
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			defer wg.Done()
+			update := d.Clone()
+			update.Draw(1)
+			err := s.UpdateDeck(ctx, update)
+			var conflict *storage.ConflictError
+			if err != nil && !errors.As(err, &conflict) {
+				t.Errorf("Expected ConflictError for losing writers, got %v", err)
+			}
+			if err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one update to succeed, %d did", succeeded)
+	}
+	dd, _ := s.GetDeck(ctx, d.ID)
+	if dd.Version != d.Version+1 || len(dd.Cards) != 51 {
+		t.Errorf("Expected a single update to be stored, got version %d with %d cards", dd.Version, len(dd.Cards))
+	}
+}
+
+// storage gives up on requests which were cancelled or ran out of time,
+// failing with the error of the context and changing nothing
+func testCancelledContextLeavesStorageUntouched(t *testing.T, newStorage Factory) {
+	s := newStorage(t)
+	stored := deck.NewDeck(uuid.New(), false, nil)
+	if err := s.SaveDeck(context.Background(), *stored); err != nil {
+		t.Fatalf("SaveDeck failed: %s", err)
+	}
+	before, _ := s.DeckHistory(context.Background(), stored.ID)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	for _, c := range []struct {
+		name     string
+		ctx      context.Context
+		expected error
+	}{
+		{"Cancelled", cancelled, context.Canceled},
+		{"Deadline Exceeded", expired, context.DeadlineExceeded},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := c.ctx
+			unsaved := deck.NewDeck(uuid.New(), false, nil)
+			update := before.Clone()
+			update.Draw(1)
+			_, mutateErr := s.MutateDeck(ctx, stored.ID, func(d *deck.Deck) error {
+				t.Errorf("MutateDeck called fn with a done context")
+				d.Draw(1)
+				return nil
+			})
+			_, listErr := s.List(ctx, storage.ListFilter{}, "")
+			_, historyErr := s.DeckHistory(ctx, stored.ID)
+
+			for method, err := range map[string]error{
+				"SaveDeck":    s.SaveDeck(ctx, *unsaved),
+				"UpdateDeck":  s.UpdateDeck(ctx, update),
+				"MutateDeck":  mutateErr,
+				"DeleteDeck":  s.DeleteDeck(ctx, stored.ID),
+				"List":        listErr,
+				"DeckHistory": historyErr,
+			} {
+				if !errors.Is(err, c.expected) {
+					t.Errorf("Expected %s to fail with %v, got %v", method, c.expected, err)
+				}
+			}
+
+			ctx = context.Background()
+			if _, found := s.GetDeck(ctx, unsaved.ID); found {
+				t.Errorf("SaveDeck stored a deck with a done context")
+			}
+			after, err := s.DeckHistory(ctx, stored.ID)
+			if err != nil {
+				t.Fatalf("Deck is gone after writes with a done context: %s", err)
+			}
+			if after.Version != before.Version || len(after.Cards) != len(before.Cards) {
+				t.Errorf("Deck changed by writes with a done context: version %d, %d cards", after.Version, len(after.Cards))
+			}
+		})
+	}
+}
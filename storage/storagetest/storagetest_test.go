@@ -0,0 +1,266 @@
+package storagetest_test
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+	"deck-of-cards/storage"
+	"deck-of-cards/storage/storagetest"
+)
+
+// mapStorage is storage written the way backends outside the storage
+// package have to write it, with nothing but the exported API
+type mapStorage struct {
+	settings storage.Settings
+
+	mu         sync.Mutex
+	decks      map[uuid.UUID]deck.Deck
+	deletedAt  map[uuid.UUID]time.Time
+	tombstones map[uuid.UUID]deck.Deck
+	events     map[uuid.UUID][]deck.Event
+}
+
+func newMapStorage(opts ...storage.Option) *mapStorage {
+	return &mapStorage{
+		settings:   storage.ApplyOptions(opts...),
+		decks:      make(map[uuid.UUID]deck.Deck),
+		deletedAt:  make(map[uuid.UUID]time.Time),
+		tombstones: make(map[uuid.UUID]deck.Deck),
+		events:     make(map[uuid.UUID][]deck.Event),
+	}
+}
+
+// takeEvents takes the new events off d and records the actor from ctx on
+// them, on a copy, the events may be shared with the caller's deck
+func takeEvents(ctx context.Context, d *deck.Deck) []deck.Event {
+	events := append([]deck.Event(nil), d.TakeEvents()...)
+	for i := range events {
+		if events[i].Actor == "" {
+			events[i].Actor = storage.ActorFromContext(ctx)
+		}
+	}
+	return events
+}
+
+// should be called with the lock held, puts d and the events taken off it
+func (s *mapStorage) put(d deck.Deck, events []deck.Event) {
+	from := d.RecordedEvents - len(events)
+	s.events[d.ID] = append(s.events[d.ID][:from:from], events...)
+	s.decks[d.ID] = d
+}
+
+// should be called with the lock held
+func (s *mapStorage) lookup(id uuid.UUID) (deck.Deck, bool) {
+	d, found := s.decks[id]
+	if found && s.settings.Expired(d) {
+		s.forget(id)
+		return deck.Deck{}, false
+	}
+	return d, found
+}
+
+// should be called with the lock held
+func (s *mapStorage) deleted(id uuid.UUID) bool {
+	deletedAt, found := s.deletedAt[id]
+	if found && s.settings.TombstoneExpired(deletedAt) {
+		s.forget(id)
+		return false
+	}
+	return found
+}
+
+// should be called with the lock held
+func (s *mapStorage) forget(id uuid.UUID) {
+	delete(s.decks, id)
+	delete(s.deletedAt, id)
+	delete(s.tombstones, id)
+	delete(s.events, id)
+}
+
+// should be called with the lock held
+func (s *mapStorage) notFound(id uuid.UUID) error {
+	if s.deleted(id) {
+		return fmt.Errorf("%w: %w: id=%v", storage.ErrDeckNotFound, storage.ErrDeckGone, id)
+	}
+	return fmt.Errorf("%w: id=%v", storage.ErrDeckNotFound, id)
+}
+
+func (s *mapStorage) SaveDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.forget(d.ID)
+	d = d.Clone()
+	d.RecordedEvents = 0
+	s.put(d, takeEvents(ctx, &d))
+	return nil
+}
+
+func (s *mapStorage) GetDeck(ctx context.Context, id uuid.UUID) (deck.Deck, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, found := s.lookup(id)
+	if !found {
+		return deck.Deck{}, false
+	}
+	if s.settings.TouchRead(&d) {
+		s.decks[id] = d
+	}
+	return d.Clone(), true
+}
+
+func (s *mapStorage) DeleteDeck(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, found := s.lookup(id)
+	if !found {
+		return s.notFound(id)
+	}
+	d.MarkDeleted()
+	events := takeEvents(ctx, &d)
+	s.put(d, events)
+	delete(s.decks, id)
+	s.tombstones[id] = d
+	s.deletedAt[id] = s.settings.Now()
+	return nil
+}
+
+func (s *mapStorage) DeckDeleted(ctx context.Context, id uuid.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleted(id)
+}
+
+func (s *mapStorage) UpdateDeck(ctx context.Context, d deck.Deck) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, found := s.lookup(d.ID)
+	if !found {
+		return s.notFound(d.ID)
+	}
+	if stored.Version != d.Version {
+		return &storage.ConflictError{ID: d.ID, Expected: d.Version, Actual: stored.Version}
+	}
+	d = d.Clone()
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	s.put(d, events)
+	return nil
+}
+
+func (s *mapStorage) MutateDeck(ctx context.Context, id uuid.UUID, fn storage.MutateFunc) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, found := s.lookup(id)
+	if !found {
+		return deck.Deck{}, s.notFound(id)
+	}
+	d = d.Clone()
+	if err := fn(&d); err != nil {
+		return deck.Deck{}, err
+	}
+	events := takeEvents(ctx, &d)
+	s.settings.Touch(&d)
+	d.Version++
+	s.put(d, events)
+	return d.Clone(), nil
+}
+
+func (s *mapStorage) List(ctx context.Context, filter storage.ListFilter, cursor string) (storage.ListPage, error) {
+	if err := ctx.Err(); err != nil {
+		return storage.ListPage{}, err
+	}
+	after, err := storage.ParseCursor(cursor)
+	if err != nil {
+		return storage.ListPage{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matched []deck.Deck
+	for _, d := range s.decks {
+		if !s.settings.Expired(d) && filter.Match(d) && after.Less(storage.CursorOf(d)) {
+			matched = append(matched, d.Clone())
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return storage.CursorOf(matched[i]).Less(storage.CursorOf(matched[j]))
+	})
+
+	var page storage.ListPage
+	if size := filter.PageSize(); len(matched) > size {
+		matched = matched[:size]
+		page.NextCursor = storage.CursorOf(matched[size-1]).String()
+	}
+	page.Decks = matched
+	return page, nil
+}
+
+func (s *mapStorage) DeckHistory(ctx context.Context, id uuid.UUID) (deck.Deck, error) {
+	if err := ctx.Err(); err != nil {
+		return deck.Deck{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, found := s.lookup(id)
+	if !found {
+		if !s.deleted(id) {
+			return deck.Deck{}, s.notFound(id)
+		}
+		d = s.tombstones[id]
+	}
+	d.Events = s.events[id]
+	d.RecordedEvents = 0
+	return d.Clone(), nil
+}
+
+func (s *mapStorage) EvictExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := 0
+	for id, d := range s.decks {
+		if s.settings.Expired(d) {
+			s.forget(id)
+			evicted++
+		}
+	}
+	for id := range s.deletedAt {
+		s.deleted(id)
+	}
+	return evicted
+}
+
+// the suite runs against storage outside the storage package, which reads
+// its options through storage.ApplyOptions
+func TestRunConformanceOutsideStoragePackage(t *testing.T) {
+	storagetest.RunConformance(t, func(t *testing.T, opts ...storage.Option) storagetest.Storage {
+		return newMapStorage(opts...)
+	})
+}
@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"deck-of-cards/deck"
+)
+
+const (
+	snapshotFileName = "snapshot.json"
+	// every record is prefixed with the length and the CRC-32 of its payload,
+	// so a record torn by a crash is detected on replay
+	walHeaderSize = 8
+)
+
+type walOp string
+
+const (
+	walPut    walOp = "put"
+	walDelete walOp = "delete"
+	walTouch  walOp = "touch"
+)
+
+// walRecord is a single write to InMemoryStorage. Puts carry the whole deck,
+// so replaying a record doesn't depend on the state before it, but only the
+// events the write recorded, which are appended to the history. Deletes
+// carry the last state of the deck for its tombstone, touches only the
+// access time
+type walRecord struct {
+	Op   walOp      `json:"op"`
+	Deck *deck.Deck `json:"deck,omitempty"`
+	// Events end the history at the RecordedEvents of the deck
+	Events     []deck.Event `json:"events,omitempty"`
+	ID         uuid.UUID    `json:"id"`
+	DeletedAt  time.Time    `json:"deleted_at"`
+	AccessedAt time.Time    `json:"accessed_at"`
+}
+
+type snapshot struct {
+	// Log is the generation of the first log written after the snapshot
+	Log        int                        `json:"log"`
+	Decks      []deck.Deck                `json:"decks"`
+	Tombstones map[uuid.UUID]tombstone    `json:"tombstones"`
+	Events     map[uuid.UUID][]deck.Event `json:"events"`
+}
+
+// walFile is the part of *os.File the log writes with
+type walFile interface {
+	Write(b []byte) (int, error)
+	Sync() error
+	Truncate(size int64) error
+	Seek(offset int64, whence int) (int64, error)
+	Close() error
+}
+
+// writeAheadLog appends records to numbered log files in dir. Every snapshot
+// starts a new log, and logs older than the latest snapshot are removed
+type writeAheadLog struct {
+	// mu serialises appends from different shards
+	mu   sync.Mutex
+	dir  string
+	gen  int
+	file walFile
+	// size is the end of the last complete record
+	size int64
+	// broken is set when a failed record couldn't be cut off, the log can't
+	// tell which records made it to disk anymore, so it takes no more of them
+	broken error
+	// snapshotMu makes sure snapshots are written in the order they are taken
+	snapshotMu sync.Mutex
+}
+
+func walFileName(gen int) string {
+	return fmt.Sprintf("wal-%010d.log", gen)
+}
+
+// append writes the record and syncs it to disk. A record that fails to be
+// written or synced is cut off, so it isn't replayed on restart even though
+// the write failed, and doesn't hide the records appended after it
+func (l *writeAheadLog) append(rec walRecord) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.broken != nil {
+		return fmt.Errorf("write-ahead log is unusable: %w", l.broken)
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[walHeaderSize:], payload)
+
+	if _, err := l.file.Write(frame); err != nil {
+		l.cutOff()
+		return fmt.Errorf("appending to write-ahead log: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		l.cutOff()
+		return fmt.Errorf("syncing write-ahead log: %w", err)
+	}
+	l.size += int64(len(frame))
+	return nil
+}
+
+// cutOff drops everything after the last complete record, should be called
+// with the lock held
+func (l *writeAheadLog) cutOff() {
+	err := l.file.Truncate(l.size)
+	if err == nil {
+		_, err = l.file.Seek(l.size, 0)
+	}
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Error cutting off failed write-ahead log record")
+		l.broken = err
+	}
+}
+
+// rotate switches to the next log file
+func (l *writeAheadLog) rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(l.dir, walFileName(l.gen+1)), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(l.dir); err != nil {
+		file.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.gen++
+	l.size = 0
+	return nil
+}
+
+// removeBefore deletes the logs older than gen, which are covered by a snapshot
+func (l *writeAheadLog) removeBefore(gen int) error {
+	gens, err := walGenerations(l.dir)
+	if err != nil {
+		return err
+	}
+	for _, g := range gens {
+		if g < gen {
+			if err := os.Remove(filepath.Join(l.dir, walFileName(g))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walGenerations lists the generations of the logs in dir in ascending order
+func walGenerations(dir string) ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	var gens []int
+	for _, path := range paths {
+		var gen int
+		if _, err := fmt.Sscanf(filepath.Base(path), "wal-%d.log", &gen); err == nil {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// replayLog applies the complete records of the log and returns the offset
+// where they end. torn is set when the log ends with an incomplete or
+// corrupt record, like the one being written during a crash
+func replayLog(path string, apply func(walRecord)) (size int64, torn bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false, err
+	}
+	for int(size) < len(data) {
+		rest := data[size:]
+		if len(rest) < walHeaderSize {
+			return size, true, nil
+		}
+		n := int(binary.LittleEndian.Uint32(rest[0:4]))
+		if len(rest)-walHeaderSize < n {
+			return size, true, nil
+		}
+		payload := rest[walHeaderSize : walHeaderSize+n]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(rest[4:8]) {
+			return size, true, nil
+		}
+		var rec walRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return size, true, nil
+		}
+		apply(rec)
+		size += int64(walHeaderSize + n)
+	}
+	return size, false, nil
+}
+
+// NewDurableInMemoryStorage keeps decks in memory like NewInMemoryStorage,
+// but appends every write to a log in dir before applying it, and restores
+// the decks from the latest snapshot and the logs after it on startup.
+// Reads are logged like they are recorded by the other backends, only once
+// the access time of the deck lags by a tenth of its TTL
+func NewDurableInMemoryStorage(dir string, opts ...Option) (*InMemoryStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %w", err)
+	}
+	s := NewInMemoryStorage(opts...)
+
+	gen := 0
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	switch {
+	case err == nil:
+		var snap snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("decoding snapshot: %w", err)
+		}
+		for _, d := range snap.Decks {
+			s.shard(d.ID).decks[d.ID] = d
+		}
+		for id, t := range snap.Tombstones {
+			s.shard(id).tombstones[id] = t
+		}
+		for id, events := range snap.Events {
+			s.shard(id).events[id] = events
+		}
+		gen = snap.Log
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	gens, err := walGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	var size int64
+	for i, g := range gens {
+		if g < gen {
+			continue
+		}
+		path := filepath.Join(dir, walFileName(g))
+		var torn bool
+		if size, torn, err = replayLog(path, s.apply); err != nil {
+			return nil, fmt.Errorf("replaying %s: %w", path, err)
+		}
+		if torn && i < len(gens)-1 {
+			return nil, fmt.Errorf("replaying %s: log is corrupt at offset %d", path, size)
+		}
+		if torn {
+			logrus.WithField("offset", size).Warnf("Truncating torn record at the end of %s", path)
+		}
+		gen = g
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, walFileName(gen)), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// cut off the torn record, if any, and append after the last complete one
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.wal = &writeAheadLog{dir: dir, gen: gen, file: file, size: size}
+	return s, nil
+}
+
+// should be called with the lock of the deck's shard held, or before the
+// storage is shared
+func (s *InMemoryStorage) apply(rec walRecord) {
+	switch rec.Op {
+	case walPut:
+		sh := s.shard(rec.Deck.ID)
+		delete(sh.tombstones, rec.Deck.ID)
+		sh.decks[rec.Deck.ID] = *rec.Deck
+		s.appendEvents(sh, *rec.Deck, rec.Events)
+	case walDelete:
+		sh := s.shard(rec.ID)
+		delete(sh.decks, rec.ID)
+		t := tombstone{DeletedAt: rec.DeletedAt, Deck: deck.Deck{ID: rec.ID}}
+		if rec.Deck != nil {
+			t.Deck = *rec.Deck
+		}
+		sh.tombstones[rec.ID] = t
+		s.appendEvents(sh, t.Deck, rec.Events)
+	case walTouch:
+		sh := s.shard(rec.ID)
+		if d, found := sh.decks[rec.ID]; found {
+			d.LastAccessedAt = rec.AccessedAt
+			sh.decks[rec.ID] = d
+		}
+	}
+}
+
+// should be called with the lock of the deck's shard held, the events end
+// the history at the RecordedEvents of d
+func (s *InMemoryStorage) appendEvents(sh *inMemoryShard, d deck.Deck, events []deck.Event) {
+	sh.events[d.ID] = appendEvents(sh.events[d.ID], d.RecordedEvents-len(events), events)
+}
+
+// should be called with the lock of the deck's shard held, logs the record if the storage is durable
+func (s *InMemoryStorage) log(rec walRecord) error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.append(rec)
+}
+
+// Snapshot writes all decks to disk and removes the logs it covers, so
+// startup doesn't have to replay every write ever made. It does nothing
+// for storage made with NewInMemoryStorage
+func (s *InMemoryStorage) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.wal.snapshotMu.Lock()
+	defer s.wal.snapshotMu.Unlock()
+
+	// the snapshot has to match the logs exactly, so every shard is locked
+	// until the log is rotated. Stored decks and histories are never changed
+	// in place, so copying the maps is enough to encode them after unlocking
+	s.lockAll()
+	snap := snapshot{
+		Log:        s.wal.gen + 1,
+		Decks:      []deck.Deck{},
+		Tombstones: make(map[uuid.UUID]tombstone),
+		Events:     make(map[uuid.UUID][]deck.Event),
+	}
+	for _, sh := range s.shards {
+		for _, d := range sh.decks {
+			snap.Decks = append(snap.Decks, d)
+		}
+		for id, t := range sh.tombstones {
+			snap.Tombstones[id] = t
+		}
+		for id, events := range sh.events {
+			snap.Events[id] = events
+		}
+	}
+	err := s.wal.rotate()
+	s.unlockAll()
+	if err != nil {
+		return fmt.Errorf("taking snapshot: %w", err)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encoding snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(s.wal.dir, filepath.Join(s.wal.dir, snapshotFileName), data); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	return s.wal.removeBefore(snap.Log)
+}
+
+// RunSnapshots takes a snapshot every interval until ctx is cancelled
+func (s *InMemoryStorage) RunSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logrus.Debug("Storage snapshots stopped")
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				logrus.WithError(err).Error("Failure in taking storage snapshot")
+			}
+		}
+	}
+}
+
+// Close closes the log of durable storage
+func (s *InMemoryStorage) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.wal.mu.Lock()
+	defer s.wal.mu.Unlock()
+	return s.wal.file.Close()
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"deck-of-cards/deck"
+)
+
+func openDurable(t *testing.T, dir string, opts ...Option) *InMemoryStorage {
+	t.Helper()
+	s, err := NewDurableInMemoryStorage(dir, opts...)
+	if err != nil {
+		t.Fatalf("NewDurableInMemoryStorage failed: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func drawOne(t *testing.T, s DeckStorage, id uuid.UUID) deck.Deck {
+	t.Helper()
+	d, err := s.MutateDeck(context.Background(), id, func(d *deck.Deck) error {
+		d.Draw(1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("MutateDeck failed: %s", err)
+	}
+	return d
+}
+
+func TestDurableInMemoryStorageRestoresSnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s := openDurable(t, dir)
+
+	before := saveDeck(t, s, true)
+	drawOne(t, s, before.ID)
+	deleted := saveDeck(t, s, false)
+	if err := s.DeleteDeck(ctx, deleted.ID); err != nil {
+		t.Fatalf("DeleteDeck failed: %s", err)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %s", err)
+	}
+	after := saveDeck(t, s, false)
+	before = drawOne(t, s, before.ID)
+	histories := make(map[uuid.UUID]deck.Deck)
+	for _, id := range []uuid.UUID{before.ID, deleted.ID, after.ID} {
+		histories[id], _ = s.DeckHistory(ctx, id)
+	}
+	s.Close()
+
+	gens, _ := walGenerations(dir)
+	if len(gens) != 1 {
+		t.Errorf("Expected snapshot to remove the logs it covers, got generations %v", gens)
+	}
+
+	reopened := openDurable(t, dir)
+	for _, d := range []deck.Deck{before, after} {
+		stored, found := reopened.shard(d.ID).decks[d.ID]
+		if !found {
+			t.Fatalf("Deck %v was lost on restart", d.ID)
+		}
+		if !reflect.DeepEqual(d, stored) {
+			t.Errorf("Deck changed on restart:\n%+v\n%+v", d, stored)
+		}
+	}
+	if !reopened.DeckDeleted(ctx, deleted.ID) {
+		t.Errorf("Tombstone was lost on restart")
+	}
+	for id, want := range histories {
+		if got, _ := reopened.DeckHistory(ctx, id); !reflect.DeepEqual(got.Events, want.Events) {
+			t.Errorf("History of deck %v changed on restart:\n%+v\n%+v", id, want.Events, got.Events)
+		}
+	}
+}
+
+// snapshots are encoded after the shards are unlocked, writes meanwhile must
+// not change what they encode, run with -race
+func TestDurableInMemoryStorageSnapshotsWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s := openDurable(t, dir)
+	d := saveDeck(t, s, true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			drawOne(t, s, d.ID)
+			// saving over replaces the history the snapshot may hold
+			if i%5 == 4 {
+				history, _ := s.DeckHistory(ctx, d.ID)
+				if err := s.SaveDeck(ctx, history); err != nil {
+					t.Errorf("SaveDeck failed: %s", err)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := s.Snapshot(); err != nil {
+			t.Fatalf("Snapshot failed: %s", err)
+		}
+	}
+	<-done
+	want, _ := s.DeckHistory(ctx, d.ID)
+	s.Close()
+
+	reopened := openDurable(t, dir)
+	if got, _ := reopened.DeckHistory(ctx, d.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("Deck changed on restart:\n%+v\n%+v", want, got)
+	}
+}
+
+func TestDurableInMemoryStorageRestoresRecordedAccess(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().UTC().Round(0)
+	clock := WithClock(func() time.Time { return now })
+	s := openDurable(t, dir, WithTTL(time.Hour), clock)
+	d := saveDeck(t, s, false)
+
+	now = now.Add(10 * time.Minute)
+	if _, found := s.GetDeck(context.Background(), d.ID); !found {
+		t.Fatalf("Deck not found")
+	}
+	s.Close()
+
+	reopened := openDurable(t, dir, WithTTL(time.Hour), clock)
+	if got := reopened.shard(d.ID).decks[d.ID].LastAccessedAt; !got.Equal(now) {
+		t.Errorf("Expected access at %v to survive restart, got %v", now, got)
+	}
+}
+
+// a crash while appending leaves the last record incomplete, recovery drops
+// it and keeps everything written before it
+func TestDurableInMemoryStorageRecoversTornLog(t *testing.T) {
+	tests := []struct {
+		name string
+		tear func(data []byte, lastRecord int) []byte
+	}{
+		{"Cut In Payload", func(data []byte, lastRecord int) []byte {
+			return data[:len(data)-10]
+		}},
+		{"Cut In Header", func(data []byte, lastRecord int) []byte {
+			return data[:lastRecord+3]
+		}},
+		{"Corrupt Payload", func(data []byte, lastRecord int) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}},
+		{"Garbage Length", func(data []byte, lastRecord int) []byte {
+			copy(data[lastRecord:], []byte{0xff, 0xff, 0xff, 0x7f})
+			return data
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openDurable(t, dir)
+			kept := saveDeck(t, s, true)
+			drawOne(t, s, kept.ID)
+			lastRecord := s.wal.size
+			torn := saveDeck(t, s, false)
+			s.Close()
+
+			path := filepath.Join(dir, walFileName(0))
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Error reading log: %s", err)
+			}
+			if err := os.WriteFile(path, tc.tear(data, int(lastRecord)), 0o644); err != nil {
+				t.Fatalf("Error tearing log: %s", err)
+			}
+
+			reopened := openDurable(t, dir)
+			d, found := reopened.shard(kept.ID).decks[kept.ID]
+			if !found || len(d.Cards) != 51 {
+				t.Fatalf("Expected the records before the torn one to be replayed")
+			}
+			if _, found := reopened.shard(torn.ID).decks[torn.ID]; found {
+				t.Errorf("Expected the torn record to be dropped")
+			}
+
+			// new records go after the last complete one and survive the next restart
+			appended := saveDeck(t, reopened, false)
+			reopened.Close()
+			again := openDurable(t, dir)
+			if _, found := again.shard(appended.ID).decks[appended.ID]; !found {
+				t.Errorf("Deck written after recovery was lost")
+			}
+			if _, found := again.shard(kept.ID).decks[kept.ID]; !found {
+				t.Errorf("Deck written before the crash was lost")
+			}
+		})
+	}
+}
+
+// flakyFile fails the next n syncs of the log
+type flakyFile struct {
+	*os.File
+	failSyncs int
+}
+
+func (f *flakyFile) Sync() error {
+	if f.failSyncs > 0 {
+		f.failSyncs--
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func TestDurableInMemoryStorageCutsOffUnsyncedRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openDurable(t, dir)
+	kept := saveDeck(t, s, false)
+
+	file := &flakyFile{File: s.wal.file.(*os.File), failSyncs: 1}
+	s.wal.file = file
+	failed := deck.NewDeck(uuid.New(), false, nil)
+	if err := s.SaveDeck(context.Background(), *failed); err == nil {
+		t.Fatalf("Expected SaveDeck to fail when the log can't be synced")
+	}
+	if _, found := s.GetDeck(context.Background(), failed.ID); found {
+		t.Errorf("Deck which failed to be logged was stored")
+	}
+	appended := saveDeck(t, s, false)
+	s.Close()
+
+	reopened := openDurable(t, dir)
+	if _, found := reopened.shard(failed.ID).decks[failed.ID]; found {
+		t.Errorf("Deck which failed to be logged came back on restart")
+	}
+	for _, d := range []deck.Deck{kept, appended} {
+		if _, found := reopened.shard(d.ID).decks[d.ID]; !found {
+			t.Errorf("Deck %v logged around the failed record was lost", d.ID)
+		}
+	}
+}
+
+func TestDurableInMemoryStorageStopsWhenRecordCantBeCutOff(t *testing.T) {
+	s := openDurable(t, t.TempDir())
+	s.wal.file = &flakyFile{File: s.wal.file.(*os.File), failSyncs: 2}
+
+	ctx := context.Background()
+	if err := s.SaveDeck(ctx, *deck.NewDeck(uuid.New(), false, nil)); err == nil {
+		t.Fatalf("Expected SaveDeck to fail when the log can't be synced")
+	}
+	// the log syncs fine again, but it can't tell whether the failed record is in it
+	if err := s.SaveDeck(ctx, *deck.NewDeck(uuid.New(), false, nil)); err == nil {
+		t.Errorf("Expected writes to fail once a failed record couldn't be cut off")
+	}
+}